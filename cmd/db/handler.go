@@ -0,0 +1,544 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ypapish/software-architecture-lab5/datastore"
+)
+
+// newHandler serves the key-value API on db. Operations that need a
+// capability db lacks respond with 501 Not Implemented.
+func newHandler(db datastore.Store, rp *replica, backupDir string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			listKeys(db, w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if rp.readOnly() {
+			http.Error(w, "Read-only follower", http.StatusForbidden)
+			return
+		}
+		batcher, ok := db.(datastore.BatchStore)
+		if !ok {
+			notImplemented(w, "batches")
+			return
+		}
+
+		var data struct {
+			Ops []struct {
+				Op    string
+				Key   string
+				Value string
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		var batch datastore.Batch
+		for _, op := range data.Ops {
+			if op.Key == "" {
+				http.Error(w, "Key required", http.StatusBadRequest)
+				return
+			}
+			switch op.Op {
+			case "put":
+				batch.Put(op.Key, op.Value)
+			case "delete":
+				batch.Delete(op.Key)
+			default:
+				http.Error(w, "Unknown operation "+op.Op, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := batcher.WriteBatch(&batch); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		if key == "" {
+			http.Error(w, "Key required", http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodGet && rp.readOnly() {
+			http.Error(w, "Read-only follower", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			value, err := db.Get(key)
+			var response any = map[string]string{"key": key, "value": value}
+			tag := etag(value)
+			if typed, ok := db.(datastore.TypedStore); ok && err == datastore.ErrTypeMismatch {
+				var n int64
+				n, err = typed.GetInt64(key)
+				response = map[string]any{"key": key, "value": n, "type": "int64"}
+				tag = etag(strconv.FormatInt(n, 10))
+			}
+			if err != nil {
+				if err == datastore.ErrNotFound {
+					http.NotFound(w, r)
+				} else if errors.Is(err, datastore.ErrCorrupted) {
+					log.Printf("Corrupted record for key %s: %s", key, err)
+					http.Error(w, "Corrupted record", http.StatusInternalServerError)
+				} else {
+					http.Error(w, "DB error", http.StatusInternalServerError)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", tag)
+			json.NewEncoder(w).Encode(response)
+
+		case http.MethodPost:
+			var data struct {
+				Op    string
+				Delta *int64
+				Value json.RawMessage
+				Type  string
+				TTL   float64 // seconds
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+
+			switch data.Op {
+			case "", "put":
+			case "incr":
+				increment(db, key, data.Delta, w, r)
+				return
+			default:
+				http.Error(w, "Unknown operation "+data.Op, http.StatusBadRequest)
+				return
+			}
+
+			// A ttl must come out as a positive time.Duration.
+			ttl := time.Duration(data.TTL * float64(time.Second))
+			if data.TTL < 0 || data.TTL >= math.MaxInt64/float64(time.Second) || data.TTL > 0 && ttl <= 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+
+			if data.Type == "int64" {
+				typed, ok := db.(datastore.TypedStore)
+				if !ok {
+					notImplemented(w, "int64 values")
+					return
+				}
+				var n int64
+				if err := json.Unmarshal(data.Value, &n); err != nil {
+					http.Error(w, "Invalid int64 value", http.StatusBadRequest)
+					return
+				}
+				if data.TTL > 0 || r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+					http.Error(w, "ttl and conditional headers are only supported for string values", http.StatusBadRequest)
+					return
+				}
+				if err := typed.PutInt64(key, n); err != nil {
+					writeError(w, err)
+					return
+				}
+				w.Header().Set("ETag", etag(strconv.FormatInt(n, 10)))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			if data.Type != "" && data.Type != "string" {
+				http.Error(w, "Unknown type "+data.Type, http.StatusBadRequest)
+				return
+			}
+
+			var value string
+			if len(data.Value) > 0 {
+				if err := json.Unmarshal(data.Value, &value); err != nil {
+					http.Error(w, "Invalid string value", http.StatusBadRequest)
+					return
+				}
+			}
+
+			if data.TTL > 0 {
+				if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+					http.Error(w, "ttl cannot be combined with conditional headers", http.StatusBadRequest)
+					return
+				}
+				expiring, ok := db.(datastore.ExpiringStore)
+				if !ok {
+					notImplemented(w, "ttl")
+					return
+				}
+				if err := expiring.PutWithTTL(key, value, ttl); err != nil {
+					writeError(w, err)
+					return
+				}
+				w.Header().Set("ETag", etag(value))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+
+			if err := conditionalPut(db, key, value, r.Header); err != nil {
+				switch err {
+				case datastore.ErrNotFound, datastore.ErrExists, datastore.ErrConflict, datastore.ErrTypeMismatch:
+					http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+				case errNotImplemented:
+					notImplemented(w, "conditional headers")
+				default:
+					writeError(w, err)
+				}
+				return
+			}
+			w.Header().Set("ETag", etag(value))
+			w.WriteHeader(http.StatusCreated)
+
+		case http.MethodDelete:
+			if err := db.Delete(key); err != nil {
+				if err == datastore.ErrNotFound {
+					http.NotFound(w, r)
+				} else {
+					writeError(w, err)
+				}
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s, ok := db.(datastore.StatsStore)
+		if !ok {
+			notImplemented(w, "stats")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statsResponse(s.Stats()))
+	})
+
+	mux.HandleFunc("/admin/backups", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			backups, err := listBackups(backupDir)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(backups)
+
+		case http.MethodPost:
+			snapshotter, ok := db.(datastore.Snapshotter)
+			if !ok {
+				notImplemented(w, "backups")
+				return
+			}
+			name := time.Now().UTC().Format("20060102T150405.000000000Z")
+			if err := snapshotter.Snapshot(filepath.Join(backupDir, name)); err != nil {
+				log.Printf("Backup %s failed: %s", name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"name": name})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	return mux
+}
+
+// errNotImplemented reports that the store lacks a capability a request
+// needs.
+var errNotImplemented = errors.New("not supported by this store")
+
+func notImplemented(w http.ResponseWriter, what string) {
+	http.Error(w, "This store does not support "+what, http.StatusNotImplemented)
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+func listKeys(db datastore.Store, w http.ResponseWriter, r *http.Request) {
+	scanner, ok := db.(datastore.ScanStore)
+	if !ok {
+		notImplemented(w, "listing keys")
+		return
+	}
+	query := r.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("after")
+
+	limit := defaultListLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	start := prefix
+	if after != "" && after+"\x00" > start {
+		start = after + "\x00"
+	}
+
+	// One key more than the page tells whether there is a next page.
+	it := scanner.ScanLimit(start, datastore.PrefixEnd(prefix), limit+1)
+	defer it.Close()
+
+	type item struct {
+		Key   string `json:"key"`
+		Value any    `json:"value"`
+		Type  string `json:"type,omitempty"`
+	}
+	response := struct {
+		Items []item `json:"items"`
+		Next  string `json:"next,omitempty"`
+	}{Items: []item{}}
+
+	for it.Next() {
+		if len(response.Items) == limit {
+			response.Next = response.Items[limit-1].Key
+			break
+		}
+		if it.Type() == datastore.TypeInt64 {
+			response.Items = append(response.Items, item{Key: it.Key(), Value: it.Int64(), Type: "int64"})
+		} else {
+			response.Items = append(response.Items, item{Key: it.Key(), Value: it.Value()})
+		}
+	}
+	if err := it.Err(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func increment(db datastore.Store, key string, delta *int64, w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		http.Error(w, "Conditional headers are not supported for incr", http.StatusBadRequest)
+		return
+	}
+	typed, ok := db.(datastore.TypedStore)
+	if !ok {
+		notImplemented(w, "int64 values")
+		return
+	}
+	d := int64(1)
+	if delta != nil {
+		d = *delta
+	}
+
+	n, err := typed.Increment(key, d)
+	if err != nil {
+		switch err {
+		case datastore.ErrTypeMismatch:
+			http.Error(w, "Value is not an int64", http.StatusConflict)
+		case datastore.ErrOverflow:
+			http.Error(w, "Increment overflows int64", http.StatusConflict)
+		default:
+			writeError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(strconv.FormatInt(n, 10)))
+	json.NewEncoder(w).Encode(map[string]any{"key": key, "value": n, "type": "int64"})
+}
+
+// writeError answers a failed write: a record the store refuses is the
+// client's fault, anything else is the server's.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, datastore.ErrRecordTooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "DB error", http.StatusInternalServerError)
+}
+
+func etag(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// conditionalPut honours If-None-Match: * and If-Match with an ETag
+// returned by GET. The check and the write happen atomically in the DB.
+func conditionalPut(db datastore.Store, key, value string, header http.Header) error {
+	ifMatch := header.Get("If-Match")
+	if ifMatch == "" && header.Get("If-None-Match") != "*" {
+		return db.Put(key, value)
+	}
+	conditional, ok := db.(datastore.ConditionalStore)
+	if !ok {
+		return errNotImplemented
+	}
+	if header.Get("If-None-Match") == "*" {
+		return conditional.PutIfAbsent(key, value)
+	}
+
+	current, err := db.Get(key)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "*" && !matchesETag(ifMatch, etag(current)) {
+		return datastore.ErrConflict
+	}
+	return conditional.CompareAndSwap(key, current, value)
+}
+
+func matchesETag(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimSpace(candidate) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type segmentStats struct {
+	Name       string `json:"name"`
+	TotalBytes int64  `json:"totalBytes"`
+	LiveBytes  int64  `json:"liveBytes"`
+	DeadBytes  int64  `json:"deadBytes"`
+	LiveKeys   int64  `json:"liveKeys"`
+	DeadKeys   int64  `json:"deadKeys"`
+}
+
+type stats struct {
+	LiveKeys          int            `json:"liveKeys"`
+	TotalBytes        int64          `json:"totalBytes"`
+	LiveBytes         int64          `json:"liveBytes"`
+	DeadBytes         int64          `json:"deadBytes"`
+	GarbageRatio      float64        `json:"garbageRatio"`
+	Segments          []segmentStats `json:"segments"`
+	MergeCount        int            `json:"mergeCount"`
+	LastMerge         *time.Time     `json:"lastMerge,omitempty"`
+	LastMergeDuration float64        `json:"lastMergeSeconds"`
+	CacheHits         int64          `json:"cacheHits"`
+	CacheMisses       int64          `json:"cacheMisses"`
+	CacheBytes        int64          `json:"cacheBytes"`
+	BloomNegatives    int64          `json:"bloomNegatives"`
+	BloomFalsePos     int64          `json:"bloomFalsePositives"`
+	BloomFalsePosRate float64        `json:"bloomFalsePositiveRate"`
+	BloomBytes        int64          `json:"bloomBytes"`
+	UncompressedBytes int64          `json:"uncompressedBytes"`
+	CompressedBytes   int64          `json:"compressedBytes"`
+	CompressionRatio  float64        `json:"compressionRatio"`
+}
+
+func statsResponse(s datastore.Stats) stats {
+	res := stats{
+		LiveKeys:          s.LiveKeys,
+		TotalBytes:        s.TotalBytes,
+		LiveBytes:         s.LiveBytes,
+		DeadBytes:         s.DeadBytes,
+		GarbageRatio:      s.GarbageRatio,
+		Segments:          []segmentStats{},
+		MergeCount:        s.MergeCount,
+		LastMergeDuration: s.LastMergeDuration.Seconds(),
+		CacheHits:         s.CacheHits,
+		CacheMisses:       s.CacheMisses,
+		CacheBytes:        s.CacheBytes,
+		BloomNegatives:    s.BloomNegatives,
+		BloomFalsePos:     s.BloomFalsePositives,
+		BloomFalsePosRate: s.BloomFalsePositiveRate,
+		BloomBytes:        s.BloomBytes,
+		UncompressedBytes: s.UncompressedBytes,
+		CompressedBytes:   s.CompressedBytes,
+		CompressionRatio:  s.CompressionRatio,
+	}
+	if !s.LastMerge.IsZero() {
+		res.LastMerge = &s.LastMerge
+	}
+	for _, seg := range s.Segments {
+		res.Segments = append(res.Segments, segmentStats(seg))
+	}
+	return res
+}
+
+type backup struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// listBackups returns the complete snapshots in dir, oldest first. A
+// snapshot is complete once its MANIFEST, or SHARDS if it is sharded, or
+// LSM for the lsm engine, is written.
+func listBackups(dir string) ([]backup, error) {
+	backups := []backup{}
+	dirs, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return backups, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, d.Name())
+		marker, err := os.Stat(filepath.Join(path, "MANIFEST"))
+		if err != nil {
+			marker, err = os.Stat(filepath.Join(path, "SHARDS"))
+		}
+		if err != nil {
+			marker, err = os.Stat(filepath.Join(path, "LSM"))
+		}
+		if err != nil {
+			continue
+		}
+		b := backup{Name: d.Name(), Created: marker.ModTime().UTC()}
+		err = filepath.WalkDir(path, func(_ string, f os.DirEntry, err error) error {
+			if err != nil || f.IsDir() {
+				return err
+			}
+			if info, err := f.Info(); err == nil {
+				b.Size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
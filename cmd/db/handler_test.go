@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ypapish/software-architecture-lab5/datastore"
+)
+
+func do(t *testing.T, h http.Handler, method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	db := datastore.NewMemStore()
+	defer db.Close()
+	h := newHandler(db, &replica{}, t.TempDir())
+
+	if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"1"}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Put returned %d", rec.Code)
+	}
+	rec := do(t, h, http.MethodGet, "/db/a", "", nil)
+	var got struct{ Key, Value string }
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || rec.Code != http.StatusOK || got.Value != "1" {
+		t.Fatalf("Get returned %d %+v (%v)", rec.Code, got, err)
+	}
+	tag := rec.Header().Get("ETag")
+
+	if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"2"}`, http.Header{"If-Match": {`"stale"`}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a stale If-Match to fail, got %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"2"}`, http.Header{"If-Match": {tag}}); rec.Code != http.StatusCreated {
+		t.Errorf("Expected a matching If-Match to succeed, got %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"3"}`, http.Header{"If-None-Match": {"*"}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected If-None-Match to fail on an existing key, got %d", rec.Code)
+	}
+
+	for _, ttl := range []string{"-1", "1e-10", "1e12"} {
+		if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"4","ttl":`+ttl+`}`, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected ttl %s to be refused with 400, got %d", ttl, rec.Code)
+		}
+	}
+
+	if rec := do(t, h, http.MethodPost, "/db/n", `{"op":"incr","delta":5}`, nil); rec.Code != http.StatusOK {
+		t.Errorf("Increment returned %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/db/a", `{"op":"incr"}`, nil); rec.Code != http.StatusConflict {
+		t.Errorf("Expected incrementing a string to conflict, got %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/db", `{"ops":[{"op":"put","key":"b","value":"x"},{"op":"delete","key":"a"}]}`, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("Batch returned %d", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodGet, "/db", "", nil)
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"items":[{"key":"b","value":"x"},{"key":"n","value":5,"type":"int64"}]}` {
+		t.Errorf("Unexpected listing: %s", body)
+	}
+	if rec := do(t, h, http.MethodDelete, "/db/a", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting a missing key to return 404, got %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/stats", "", nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"liveKeys":2`) {
+		t.Errorf("Unexpected stats: %d %s", rec.Code, rec.Body)
+	}
+	// The memory store has nothing to take a backup of.
+	if rec := do(t, h, http.MethodPost, "/admin/backups", "", nil); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected backups to be unsupported, got %d", rec.Code)
+	}
+}
+
+// basicStore has only the methods every store has.
+type basicStore struct {
+	datastore.Store
+}
+
+func TestHandlerCapabilities(t *testing.T) {
+	db := basicStore{datastore.NewMemStore()}
+	defer db.Close()
+	h := newHandler(db, &replica{}, t.TempDir())
+
+	if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"1"}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Put returned %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodDelete, "/db/a", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete returned %d", rec.Code)
+	}
+	for _, req := range []struct{ method, path, body, ifNoneMatch string }{
+		{http.MethodGet, "/db", "", ""},
+		{http.MethodPost, "/db", `{"ops":[]}`, ""},
+		{http.MethodPost, "/db/a", `{"op":"incr"}`, ""},
+		{http.MethodPost, "/db/a", `{"value":"1","ttl":1}`, ""},
+		{http.MethodPost, "/db/a", `{"value":"1"}`, "*"},
+		{http.MethodGet, "/stats", "", ""},
+	} {
+		header := http.Header{}
+		if req.ifNoneMatch != "" {
+			header.Set("If-None-Match", req.ifNoneMatch)
+		}
+		if rec := do(t, h, req.method, req.path, req.body, header); rec.Code != http.StatusNotImplemented {
+			t.Errorf("%s %s %s: expected 501, got %d", req.method, req.path, req.body, rec.Code)
+		}
+	}
+}
+
+// failingStore fails every put with err.
+type failingStore struct {
+	*datastore.MemStore
+	err error
+}
+
+func (s failingStore) Put(key, value string) error {
+	return s.err
+}
+
+func (s failingStore) WriteBatch(b *datastore.Batch) error {
+	return s.err
+}
+
+func TestHandlerWriteErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: key %q", datastore.ErrRecordTooLarge, "a"), http.StatusBadRequest},
+		{errors.New("disk failure"), http.StatusInternalServerError},
+	} {
+		db := failingStore{datastore.NewMemStore(), tc.err}
+		h := newHandler(db, &replica{}, t.TempDir())
+		if rec := do(t, h, http.MethodPost, "/db/a", `{"value":"1"}`, nil); rec.Code != tc.code {
+			t.Errorf("Put failing with %q returned %d, wanted %d", tc.err, rec.Code, tc.code)
+		}
+		if rec := do(t, h, http.MethodPost, "/db", `{"ops":[{"op":"put","key":"a","value":"1"}]}`, nil); rec.Code != tc.code {
+			t.Errorf("Batch failing with %q returned %d, wanted %d", tc.err, rec.Code, tc.code)
+		}
+		db.Close()
+	}
+}
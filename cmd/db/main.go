@@ -1,70 +1,113 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"log"
-	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/ypapish/software-architecture-lab5/datastore"
 	"github.com/ypapish/software-architecture-lab5/httptools"
 	"github.com/ypapish/software-architecture-lab5/signal"
 )
 
-var port = flag.Int("port", 8081, "server port")
+var (
+	port         = flag.Int("port", 8081, "server port")
+	syncPolicy   = flag.String("sync", "batch", "fsync policy for writes: never, always, batch or interval")
+	syncInterval = flag.Duration("sync-interval", 100*time.Millisecond, "fsync period for the interval sync policy")
+	compactEvery = flag.Duration("compact-interval", 0, "also merge sealed segments on this period (0 disables)")
+	backupDir    = flag.String("backup-dir", "db_backups", "directory for snapshots taken through /admin/backups")
+	leader       = flag.String("follow", "", "replicate from the leader at this URL and serve reads only")
+	followEvery  = flag.Duration("follow-interval", 100*time.Millisecond, "how often a caught-up follower polls the leader")
+	replLog      = flag.Int("replication-log", 10000, "number of recent writes kept for followers to catch up from")
+	shards       = flag.Int("shards", 1, "number of independent shards keys are spread over")
+	cacheSize    = flag.Int64("cache-size", 0, "bytes of recently read values to keep in memory per shard (0 disables)")
+	indexKind    = flag.String("index", "memory", "where keys are indexed: memory, or disk to bound memory use with many keys")
+	bloomRate    = flag.Float64("bloom-fp-rate", 0, "false positive rate of the per-segment Bloom filters (0 disables)")
+	compressMin  = flag.Int("compress-threshold", 0, "store string values of at least this many bytes compressed (0 disables)")
+	engine       = flag.String("engine", "log", "storage engine: log for the segment log, lsm for sorted tables, or memory to keep nothing on disk")
+)
+
+var (
+	// logFlags only apply to the log engine.
+	logFlags = []string{"compact-interval", "follow", "follow-interval", "replication-log", "shards", "cache-size", "index", "compress-threshold"}
+	// diskFlags apply to the engines that keep data on disk.
+	diskFlags = []string{"sync", "sync-interval", "bloom-fp-rate"}
+)
 
 func main() {
 	flag.Parse()
 
-	db, err := datastore.Open("db_data")
-	if err != nil {
-		log.Fatal("Error opening database:", err)
+	// Flags the engine would ignore are refused instead.
+	var unsupported []string
+	switch *engine {
+	case "lsm":
+		unsupported = logFlags
+	case "memory":
+		unsupported = slices.Concat(logFlags, diskFlags)
 	}
-	defer db.Close()
-
-	http.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
-		key := strings.TrimPrefix(r.URL.Path, "/db/")
-		if key == "" {
-			http.Error(w, "Key required", http.StatusBadRequest)
-			return
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(unsupported, f.Name) {
+			log.Fatalf("The %s engine does not support -%s", *engine, f.Name)
 		}
+	})
 
-		switch r.Method {
-		case http.MethodGet:
-			value, err := db.Get(key)
-			if err != nil {
-				if err == datastore.ErrNotFound {
-					http.NotFound(w, r)
-				} else {
-					http.Error(w, "DB error", http.StatusInternalServerError)
-				}
-				return
-			}
-			response := map[string]string{"key": key, "value": value}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-
-		case http.MethodPost:
-			var data struct{ Value string }
-			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-				http.Error(w, "Invalid JSON", http.StatusBadRequest)
-				return
-			}
-			defer r.Body.Close()
+	policy, err := datastore.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		log.Fatal("Invalid sync policy:", err)
+	}
+	index, err := datastore.ParseIndexKind(*indexKind)
+	if err != nil {
+		log.Fatal("Invalid index:", err)
+	}
+	opts := []datastore.Option{datastore.WithSyncPolicy(policy), datastore.WithIndex(index)}
+	if policy == datastore.SyncInterval {
+		opts = append(opts, datastore.WithSyncInterval(*syncInterval))
+	}
+	compaction := datastore.DefaultCompactionPolicy
+	compaction.Interval = *compactEvery
+	opts = append(opts, datastore.WithCompactionPolicy(compaction), datastore.WithCache(*cacheSize), datastore.WithBloomFilter(*bloomRate), datastore.WithCompression(*compressMin))
+	// Only a single log shard serves /replication, so only it keeps the log
+	// followers catch up from.
+	if *engine == "log" && *shards == 1 {
+		opts = append(opts, datastore.WithReplicationLog(*replLog))
+	}
 
-			if err := db.Put(key, data.Value); err != nil {
-				http.Error(w, "DB error", http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusCreated)
+	if *shards > 1 && *leader != "" {
+		log.Fatal("Replication needs a single shard")
+	}
+	var db datastore.Store
+	switch *engine {
+	case "log":
+		db, err = datastore.OpenSharded("db_data", *shards, opts...)
+	case "lsm":
+		db, err = datastore.OpenLSM("db_data", opts...)
+	case "memory":
+		db = datastore.NewMemStore()
+	default:
+		log.Fatal("Invalid engine: ", *engine)
+	}
+	if err != nil {
+		log.Fatal("Error opening database:", err)
+	}
+	defer db.Close()
 
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Replication follows the log of a single Db, so it is only offered
+	// without sharding.
+	rp := &replica{}
+	mux := newHandler(db, rp, *backupDir)
+	if sdb, ok := db.(*datastore.ShardedDb); ok && sdb.Shards() == 1 {
+		rp.db = sdb.Shard(0)
+		if *leader != "" {
+			rp.follower = newFollower(rp.db, strings.TrimSuffix(*leader, "/"), *followEvery)
+			go rp.follower.run()
 		}
-	})
+		handleReplication(mux, rp.db)
+		handleReplica(mux, rp)
+	}
 
-	server := httptools.CreateServer(*port, nil)
+	server := httptools.CreateServer(*port, mux)
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ypapish/software-architecture-lab5/datastore"
+)
+
+const (
+	epochHeader = "X-Replication-Epoch"
+	seqHeader   = "X-Replication-Seq"
+	// headHeader carries the leader's own position with a log response,
+	// which the follower measures its lag against.
+	headHeader = "X-Replication-Head"
+
+	maxLogRecords = 1000
+)
+
+func setPosition(h http.Header, pos datastore.LogPosition) {
+	h.Set(epochHeader, pos.Epoch)
+	h.Set(seqHeader, strconv.FormatUint(pos.Seq, 10))
+}
+
+func handleReplication(mux *http.ServeMux, db *datastore.Db) {
+	mux.HandleFunc("/replication/log", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid seq", http.StatusBadRequest)
+			return
+		}
+		pos := datastore.LogPosition{Epoch: r.URL.Query().Get("epoch"), Seq: seq}
+		data, next, err := db.ReadLog(pos, maxLogRecords)
+		if err == datastore.ErrLogTruncated {
+			http.Error(w, "Position is no longer in the log", http.StatusGone)
+			return
+		}
+		setPosition(w.Header(), next)
+		w.Header().Set(headHeader, strconv.FormatUint(db.Position().Seq, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	})
+
+	mux.HandleFunc("/replication/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		it, pos := db.Dump()
+		defer it.Close()
+		setPosition(w.Header(), pos)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for it.Next() {
+			if _, err := w.Write(it.Record()); err != nil {
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			// The follower sees a cut-off record and starts over.
+			log.Printf("Replication dump failed: %s", err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// follower keeps db in step with the leader by polling its replication
+// log, and loads a full dump whenever the log cannot be followed.
+type follower struct {
+	db       *datastore.Db
+	leader   string
+	interval time.Duration
+	client   *http.Client
+
+	mu        sync.Mutex
+	pos       datastore.LogPosition
+	leaderSeq uint64
+	caughtUp  time.Time
+	lastErr   error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFollower(db *datastore.Db, leader string, interval time.Duration) *follower {
+	return &follower{
+		db:       db,
+		leader:   leader,
+		interval: interval,
+		client:   &http.Client{Timeout: time.Minute},
+		caughtUp: time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (f *follower) run() {
+	defer close(f.done)
+	for {
+		more, err := f.poll()
+		f.mu.Lock()
+		f.lastErr = err
+		f.mu.Unlock()
+		if err != nil {
+			log.Printf("Replication from %s failed: %s", f.leader, err)
+		}
+
+		if more && err == nil {
+			select {
+			case <-f.stop:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// Stop ends replication once the request in flight is applied.
+func (f *follower) Stop() {
+	close(f.stop)
+	<-f.done
+}
+
+// poll applies the next part of the leader's log and reports whether
+// there is more of it.
+func (f *follower) poll() (bool, error) {
+	f.mu.Lock()
+	pos := f.pos
+	f.mu.Unlock()
+
+	if pos.Epoch == "" {
+		return true, f.resync()
+	}
+
+	query := url.Values{"epoch": {pos.Epoch}, "seq": {strconv.FormatUint(pos.Seq, 10)}}
+	resp, err := f.client.Get(f.leader + "/replication/log?" + query.Encode())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		f.mu.Lock()
+		f.pos = datastore.LogPosition{}
+		f.mu.Unlock()
+		log.Printf("Fell behind the log of %s, loading a full copy", f.leader)
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("leader responded with %s", resp.Status)
+	}
+	next, err := position(resp.Header)
+	if err != nil {
+		return false, err
+	}
+	head, err := strconv.ParseUint(resp.Header.Get(headHeader), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("bad %s header: %w", headHeader, err)
+	}
+
+	if err := f.db.Apply(resp.Body); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pos, f.leaderSeq = next, head
+	if next.Seq >= head {
+		f.caughtUp = time.Now()
+	}
+	return next.Seq < head, nil
+}
+
+func (f *follower) resync() error {
+	resp, err := f.client.Get(f.leader + "/replication/dump")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded with %s", resp.Status)
+	}
+	pos, err := position(resp.Header)
+	if err != nil {
+		return err
+	}
+	if err := f.db.RestoreDump(resp.Body); err != nil {
+		return err
+	}
+	log.Printf("Loaded a full copy of %s at %s/%d", f.leader, pos.Epoch, pos.Seq)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pos, f.leaderSeq = pos, pos.Seq
+	return nil
+}
+
+func position(h http.Header) (datastore.LogPosition, error) {
+	seq, err := strconv.ParseUint(h.Get(seqHeader), 10, 64)
+	if err != nil || h.Get(epochHeader) == "" {
+		return datastore.LogPosition{}, fmt.Errorf("bad replication position in response")
+	}
+	return datastore.LogPosition{Epoch: h.Get(epochHeader), Seq: seq}, nil
+}
+
+type replicationStatus struct {
+	Role       string  `json:"role"`
+	Leader     string  `json:"leader,omitempty"`
+	Epoch      string  `json:"epoch"`
+	Seq        uint64  `json:"seq"`
+	LeaderSeq  uint64  `json:"leaderSeq,omitempty"`
+	LagRecords uint64  `json:"lagRecords"`
+	LagSeconds float64 `json:"lagSeconds"`
+	LastError  string  `json:"lastError,omitempty"`
+}
+
+// status reports the position in the leader's log. The lag in seconds is
+// how long ago the follower last had everything the leader had.
+func (f *follower) status() replicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := replicationStatus{
+		Role:      "follower",
+		Leader:    f.leader,
+		Epoch:     f.pos.Epoch,
+		Seq:       f.pos.Seq,
+		LeaderSeq: f.leaderSeq,
+	}
+	if f.leaderSeq > f.pos.Seq {
+		s.LagRecords = f.leaderSeq - f.pos.Seq
+	}
+	if s.LagRecords > 0 || f.pos.Epoch == "" {
+		s.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	if f.lastErr != nil {
+		s.LastError = f.lastErr.Error()
+	}
+	return s
+}
+
+// replica tracks whether this instance follows a leader. Writes are
+// refused until it is promoted.
+type replica struct {
+	db *datastore.Db
+
+	mu       sync.Mutex
+	follower *follower
+}
+
+func (rp *replica) readOnly() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.follower != nil
+}
+
+// promote stops following the leader and makes this instance writable.
+func (rp *replica) promote() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.follower == nil {
+		return false
+	}
+	rp.follower.Stop()
+	rp.follower = nil
+	return true
+}
+
+func (rp *replica) status() replicationStatus {
+	rp.mu.Lock()
+	f := rp.follower
+	rp.mu.Unlock()
+	if f != nil {
+		return f.status()
+	}
+	pos := rp.db.Position()
+	return replicationStatus{Role: "leader", Epoch: pos.Epoch, Seq: pos.Seq}
+}
+
+func handleReplica(mux *http.ServeMux, rp *replica) {
+	mux.HandleFunc("/replication/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rp.status())
+	})
+
+	mux.HandleFunc("/admin/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !rp.promote() {
+			http.Error(w, "Already the leader", http.StatusConflict)
+			return
+		}
+		log.Printf("Promoted to leader")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rp.status())
+	})
+}
@@ -0,0 +1,29 @@
+package datastore
+
+import "fmt"
+
+// Batch collects puts and deletes that WriteBatch applies atomically:
+// after a crash either all of them are visible or none is. Deleting a key
+// that does not exist is not an error within a batch.
+type Batch struct {
+	ops []entry
+}
+
+func (b *Batch) Put(key, value string) {
+	b.ops = append(b.ops, entry{key: key, value: value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, entry{key: key, tombstone: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (e *entry) validate() error {
+	if len(e.key)+len(e.value)+v1HeaderSize+expiresSize > maxRecordSize {
+		return fmt.Errorf("%w: key %q", ErrRecordTooLarge, e.key)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.Put("old", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Batch
+	b.Put("k1", "v1")
+	b.Put("k2", "v2")
+	b.Delete("old")
+	b.Delete("missing")
+	b.Put("tmp", "value")
+	b.Delete("tmp")
+	if err := db.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for key, expected := range map[string]string{"k1": "v1", "k2": "v2"} {
+			value, err := db.Get(key)
+			if err != nil || value != expected {
+				t.Errorf("Get(%q) = %q (%v), wanted %q", key, value, err, expected)
+			}
+		}
+		for _, key := range []string{"old", "missing", "tmp"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Get(%q) expected ErrNotFound, got %v", key, err)
+			}
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestWriteBatchRecoveryIsAtomic(t *testing.T) {
+	src := t.TempDir()
+	db, err := Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("before", "value"); err != nil {
+		t.Fatal(err)
+	}
+	batchStart := db.out.size
+
+	var b Batch
+	for i := 0; i < 3; i++ {
+		b.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	b.Delete("before")
+	if err := db.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(src, outFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := int(batchStart); cut <= len(data); cut++ {
+		tmp := t.TempDir()
+		if err := os.WriteFile(filepath.Join(tmp, outFileName), data[:cut], 0600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(tmp)
+		if err != nil {
+			t.Fatalf("Cut at %d: %s", cut, err)
+		}
+
+		applied := cut == len(data)
+		for i := 0; i < 3; i++ {
+			_, err := db.Get(fmt.Sprintf("k%d", i))
+			if applied && err != nil {
+				t.Errorf("Cut at %d: expected k%d to be written, got %v", cut, i, err)
+			}
+			if !applied && err != ErrNotFound {
+				t.Errorf("Cut at %d: expected k%d to be discarded, got %v", cut, i, err)
+			}
+		}
+		_, err = db.Get("before")
+		if applied && err != ErrNotFound {
+			t.Errorf("Cut at %d: expected 'before' to be deleted, got %v", cut, err)
+		}
+		if !applied && err != nil {
+			t.Errorf("Cut at %d: expected 'before' to survive, got %v", cut, err)
+		}
+
+		size, _ := db.Size()
+		if !applied && size != batchStart {
+			t.Errorf("Cut at %d: expected segment truncated to %d, got %d", cut, batchStart, size)
+		}
+		db.Close()
+	}
+}
+
+func TestWriteBatchStaysInOneSegment(t *testing.T) {
+	db, err := OpenWithMaxSize(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("first", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Batch
+	for i := 0; i < 5; i++ {
+		b.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+	errs := db.applyWrites([]writeRequest{{batch: &b}})
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	first, _ := db.index.Get("key0")
+	segID := first.segID
+	for i := 1; i < 5; i++ {
+		if loc, _ := db.index.Get(fmt.Sprintf("key%d", i)); loc.segID != segID {
+			t.Errorf("Batch split across segments %d and %d", segID, loc.segID)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+)
+
+const (
+	bloomSuffix = ".bloom"
+	// minBloomCapacity is the fewest keys a filter is sized for. Filters of
+	// active segments start there and are rebuilt twice as large whenever
+	// they fill up.
+	minBloomCapacity = 1024
+)
+
+var bloomMagic = []byte{'K', 'V', 'B', 1}
+
+// bloomFilter tells for a key whether it may have been added, or surely
+// has not. A segment's filter holds every key it has a live record for.
+type bloomFilter struct {
+	bits     []uint64
+	k        uint64
+	n        int64
+	capacity int64
+}
+
+func newBloomFilter(capacity int64, fpRate float64) *bloomFilter {
+	capacity = max(capacity, minBloomCapacity)
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	return &bloomFilter{
+		bits:     make([]uint64, (m+63)/64),
+		k:        max(k, 1),
+		capacity: capacity,
+	}
+}
+
+// bloomHash returns the two hashes the bit positions of a key are derived
+// from. They are stable across processes, as filters are persisted.
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	// The second hash is a splitmix64 finalizer of the first, made odd so
+	// that it steps through all positions.
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.n++
+}
+
+func (f *bloomFilter) mayContain(h1, h2 uint64) bool {
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) size() int64 {
+	return int64(len(f.bits)) * 8
+}
+
+func bloomPath(segPath string) string {
+	return segPath + bloomSuffix
+}
+
+// addToFilter adds a key with a live record in seg to its filter, rebuilding
+// the filter larger from the segment index once it is full. The caller must
+// hold mu.
+func (db *Db) addToFilter(seg *segment, key string) {
+	if seg.filter == nil || seg.filterComplete {
+		return
+	}
+	if seg.filter.n >= seg.filter.capacity {
+		seg.filter = newBloomFilter(2*seg.filter.capacity, db.bloomRate)
+		for k, info := range seg.index {
+			if !info.tombstone && k != key {
+				seg.filter.add(bloomHash(k))
+			}
+		}
+	}
+	seg.filter.add(bloomHash(key))
+}
+
+// mayContainLocked asks the segment filters whether key may exist. The
+// caller must hold mu.
+func (db *Db) mayContainLocked(key string) bool {
+	if db.bloomRate == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	for _, seg := range db.segments {
+		if seg.filter == nil || seg.filter.mayContain(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupLocked finds the location of key, asking the filters first so
+// that missing keys do not reach the index. The caller must hold mu.
+func (db *Db) lookupLocked(key string) (segmentLocation, bool) {
+	if !db.mayContainLocked(key) {
+		db.bloomNegatives.Add(1)
+		return segmentLocation{}, false
+	}
+	loc, ok := db.index.Get(key)
+	if !ok && db.bloomRate != 0 {
+		db.bloomFalsePositives.Add(1)
+	}
+	return loc, ok
+}
+
+// Persisted filter format:
+// magic(4) covered(8) k(8) n(8) capacity(8) bits(8 each) crc(4)
+//
+// covered is the segment size the filter was written for. A filter that
+// does not cover the whole segment is rebuilt.
+
+func writeFilter(seg *segment) error {
+	if seg.filter == nil {
+		return nil
+	}
+	buf := append([]byte(nil), bloomMagic...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(seg.size))
+	buf = binary.LittleEndian.AppendUint64(buf, seg.filter.k)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(seg.filter.n))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(seg.filter.capacity))
+	for _, word := range seg.filter.bits {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	path := bloomPath(seg.filePath)
+	tmpPath := path + ".tmp"
+	if err := writeFile(seg.fs, tmpPath, buf, false); err != nil {
+		seg.fs.Remove(tmpPath)
+		return err
+	}
+	return seg.fs.Rename(tmpPath, path)
+}
+
+func readFilter(seg *segment) (*bloomFilter, error) {
+	data, err := readFile(seg.fs, bloomPath(seg.filePath))
+	if err != nil {
+		return nil, err
+	}
+	const headerSize = 36
+	if len(data) < headerSize+4 || (len(data)-headerSize-4)%8 != 0 || !bytes.Equal(data[:4], bloomMagic) {
+		return nil, fmt.Errorf("unknown filter format")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	if covered := int64(binary.LittleEndian.Uint64(body[4:])); covered != seg.size {
+		return nil, fmt.Errorf("filter covers %d bytes of %d", covered, seg.size)
+	}
+
+	f := &bloomFilter{
+		k:        binary.LittleEndian.Uint64(body[12:]),
+		n:        int64(binary.LittleEndian.Uint64(body[20:])),
+		capacity: int64(binary.LittleEndian.Uint64(body[28:])),
+	}
+	for pos := headerSize; pos < len(body); pos += 8 {
+		f.bits = append(f.bits, binary.LittleEndian.Uint64(body[pos:]))
+	}
+	if len(f.bits) == 0 || f.k == 0 {
+		return nil, fmt.Errorf("%w: empty filter", ErrCorrupted)
+	}
+	return f, nil
+}
+
+// loadFilter gives seg the filter persisted next to it or, failing that,
+// an empty one to be filled while the segment is indexed.
+func (db *Db) loadFilter(seg *segment) {
+	if db.bloomRate == 0 {
+		return
+	}
+	f, err := readFilter(seg)
+	if err == nil {
+		seg.filter, seg.filterComplete = f, true
+		return
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("datastore: rebuilding filter for %s: %s", seg.filePath, err)
+	}
+	seg.filter = db.newFilter()
+}
+
+func (db *Db) newFilter() *bloomFilter {
+	if db.bloomRate == 0 {
+		return nil
+	}
+	return newBloomFilter(db.maxSize/64, db.bloomRate)
+}
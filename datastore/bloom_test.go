@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterRate(t *testing.T) {
+	const n, rate = 10000, 0.01
+	f := newBloomFilter(n, rate)
+	for i := 0; i < n; i++ {
+		f.add(bloomHash(fmt.Sprintf("key%d", i)))
+	}
+	for i := 0; i < n; i++ {
+		if !f.mayContain(bloomHash(fmt.Sprintf("key%d", i))) {
+			t.Fatalf("Filter lost key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if f.mayContain(bloomHash(fmt.Sprintf("missing%d", i))) {
+			falsePositives++
+		}
+	}
+	if got := float64(falsePositives) / n; got > 2*rate {
+		t.Errorf("Expected a false positive rate around %g, got %g", rate, got)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithMaxSize(200), WithBloomFilter(0.01), WithCompactionPolicy(CompactionPolicy{})}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fillDb(t, db, 30)
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "key1")
+
+	checkMissing := func(db *Db) {
+		t.Helper()
+		before := db.Stats()
+		for i := 0; i < 100; i++ {
+			if _, err := db.Get(fmt.Sprintf("missing%d", i)); err != ErrNotFound {
+				t.Fatalf("Expected ErrNotFound, got %v", err)
+			}
+		}
+		s := db.Stats()
+		if negatives := s.BloomNegatives - before.BloomNegatives; negatives < 90 {
+			t.Errorf("Expected the filters to answer most missing lookups, got %d of 100", negatives)
+		}
+		if s.BloomBytes == 0 {
+			t.Error("Expected the filter sizes in the stats")
+		}
+	}
+	checkContents(t, db, expected)
+	checkMissing(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealed segments keep their filters next to them.
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sealed := db.segments[len(db.segments)-2]
+	if _, err := readFilter(sealed); err != nil {
+		t.Errorf("Expected a filter for %s, got %v", sealed.filePath, err)
+	}
+	checkContents(t, db, expected)
+	checkMissing(db)
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFilter(db.segments[0]); err != nil {
+		t.Errorf("Expected a filter for the merged segment, got %v", err)
+	}
+	checkContents(t, db, expected)
+	checkMissing(db)
+	checkFiles(t, dir)
+
+	if s := db.Stats(); s.BloomFalsePositiveRate > 0.1 {
+		t.Errorf("Expected few false positives, got a rate of %g", s.BloomFalsePositiveRate)
+	}
+	if _, err := Open(t.TempDir(), WithBloomFilter(2)); err == nil {
+		t.Error("Expected an invalid false positive rate to be rejected")
+	}
+}
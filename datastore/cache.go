@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheItemOverhead roughly accounts for the bookkeeping of a cached value
+// on top of its key and value.
+const cacheItemOverhead = 96
+
+// valueCache keeps recently read records in memory, evicting the least
+// recently used ones once they take more than maxBytes. Every record is
+// cached with the location it was read from and only returned for that
+// location, so a record overwritten in the meantime is never served. A nil
+// cache caches nothing.
+type valueCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	items    map[string]*list.Element
+	lru      *list.List
+	hits     int64
+	misses   int64
+}
+
+type cacheItem struct {
+	key    string
+	loc    segmentLocation
+	record entry
+}
+
+func newValueCache(maxBytes int64) *valueCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &valueCache{
+		maxBytes: maxBytes,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (item *cacheItem) size() int64 {
+	return int64(len(item.key)+len(item.record.value)) + cacheItemOverhead
+}
+
+func (c *valueCache) get(key string, loc segmentLocation) (entry, bool) {
+	if c == nil {
+		return entry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok && el.Value.(*cacheItem).loc == loc {
+		c.lru.MoveToFront(el)
+		c.hits++
+		return el.Value.(*cacheItem).record, true
+	}
+	c.misses++
+	return entry{}, false
+}
+
+func (c *valueCache) add(key string, loc segmentLocation, record entry) {
+	if c == nil {
+		return
+	}
+	item := &cacheItem{key: key, loc: loc, record: record}
+	if item.size() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(key)
+	c.items[key] = c.lru.PushFront(item)
+	c.bytes += item.size()
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cacheItem).key)
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *valueCache) removeLocked(key string) {
+	if el, ok := c.items[key]; ok {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		c.bytes -= el.Value.(*cacheItem).size()
+	}
+}
+
+// relocate keeps a record cached after a merge moved it from one location
+// to another.
+func (c *valueCache) relocate(key string, from, to segmentLocation) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok && el.Value.(*cacheItem).loc == from {
+		el.Value.(*cacheItem).loc = to
+	}
+}
+
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+func (c *valueCache) stats() (hits, misses, bytes int64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.bytes
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	db, err := Open(t.TempDir(), WithMaxSize(200), WithCache(1<<20), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := fillDb(t, db, 30)
+	checkContents(t, db, expected)
+	if s := db.Stats(); s.CacheHits != 0 || s.CacheMisses != 7 {
+		t.Errorf("Expected 7 misses on the first reads, got %d hits and %d misses", s.CacheHits, s.CacheMisses)
+	}
+	checkContents(t, db, expected)
+	if s := db.Stats(); s.CacheHits != 7 || s.CacheBytes == 0 {
+		t.Errorf("Expected 7 hits on the second reads, got %d (%d bytes cached)", s.CacheHits, s.CacheBytes)
+	}
+
+	if err := db.Put("key0", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	expected["key0"] = "new"
+	delete(expected, "key1")
+	checkContents(t, db, expected)
+
+	// A merge moves the cached values, which stay cached.
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	hits := db.Stats().CacheHits
+	checkContents(t, db, expected)
+	if s := db.Stats(); s.CacheHits-hits != int64(len(expected)) {
+		t.Errorf("Expected %d hits after the merge, got %d", len(expected), s.CacheHits-hits)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	const maxBytes = 1000
+	db, err := Open(t.TempDir(), WithCache(maxBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		}
+		if s := db.Stats(); s.CacheBytes > maxBytes {
+			t.Fatalf("Cache grew to %d bytes, over %d", s.CacheBytes, maxBytes)
+		}
+	}
+
+	hits := db.Stats().CacheHits
+	if _, err := db.Get("key19"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.Stats(); s.CacheHits-hits != 1 {
+		t.Errorf("Expected the latest key cached and the oldest evicted, got %d hits", s.CacheHits-hits)
+	}
+}
+
+func BenchmarkGetHot(b *testing.B) {
+	for _, size := range []int64{0, 1 << 20} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			db, err := Open(b.TempDir(), WithCache(size))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 10; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), strings.Repeat("v", 100)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("key%d", i%10)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.CompareAndSwap("key", "", "value"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing key, got %v", err)
+	}
+	if err := db.PutIfAbsent("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutIfAbsent("key", "v2"); err != ErrExists {
+		t.Errorf("Expected ErrExists, got %v", err)
+	}
+	if err := db.CompareAndSwap("key", "v0", "v2"); err != ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if err := db.CompareAndSwap("key", "v1", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "v2" {
+		t.Errorf("Expected 'v2', got %q (%v)", value, err)
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutIfAbsent("key", "v3"); err != nil {
+		t.Errorf("Expected PutIfAbsent to succeed after delete, got %v", err)
+	}
+}
+
+func TestConditionalWritesSeeEarlierWritesInGroup(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	one, two := "1", "2"
+	db.writeMutex.Lock()
+	errs := db.applyWrites([]writeRequest{
+		{key: "key", value: "1"},
+		{key: "key", value: "2", expected: &one},
+		{key: "key", value: "3", expected: &one},
+		{key: "key", value: "4", ifAbsent: true},
+		{key: "key", tombstone: true},
+		{key: "key", value: "5", ifAbsent: true},
+		{key: "key", value: "6", expected: &two},
+	})
+	db.writeMutex.Unlock()
+
+	expected := []error{nil, nil, ErrConflict, ErrExists, nil, nil, ErrConflict}
+	for i, err := range errs {
+		if err != expected[i] {
+			t.Errorf("Request %d: expected %v, got %v", i, expected[i], err)
+		}
+	}
+	if value, err := db.Get("key"); err != nil || value != "5" {
+		t.Errorf("Expected '5', got %q (%v)", value, err)
+	}
+}
+
+func TestCompareAndSwapIsLinearizable(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				value, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(value)
+				err = db.CompareAndSwap("counter", value, strconv.Itoa(n+1))
+				if err == ErrConflict {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != strconv.Itoa(workers*increments) {
+		t.Errorf("Expected counter %d, got %s", workers*increments, value)
+	}
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"log"
+	"time"
+)
+
+// CompactionPolicy decides when sealed segments are merged in the
+// background. The active segment is never merged.
+type CompactionPolicy struct {
+	// MaxSealedSegments triggers a merge once there are more sealed
+	// segments than this. Zero disables the check.
+	MaxSealedSegments int
+	// MaxGarbageRatio triggers a merge once overwritten and deleted
+	// records make up more than this fraction of the sealed segments.
+	// Zero disables the check.
+	MaxGarbageRatio float64
+	// Interval, if positive, also merges on this period whenever the
+	// sealed segments have anything to reclaim, thresholds or not.
+	Interval time.Duration
+}
+
+var DefaultCompactionPolicy = CompactionPolicy{
+	MaxSealedSegments: 8,
+	MaxGarbageRatio:   0.5,
+}
+
+// Compact merges the sealed segments now, regardless of the policy.
+func (db *Db) Compact() error {
+	return db.mergeSegments()
+}
+
+// needsCompaction reports whether the policy thresholds are crossed. The
+// caller must hold writeMutex.
+func (db *Db) needsCompaction() bool {
+	sealed := db.segments[:len(db.segments)-1]
+	if len(sealed) == 0 {
+		return false
+	}
+	p := db.compaction
+	if p.MaxSealedSegments > 0 && len(sealed) > p.MaxSealedSegments {
+		return true
+	}
+	return p.MaxGarbageRatio > 0 && garbageRatio(sealed) > p.MaxGarbageRatio
+}
+
+func garbageRatio(segments []*segment) float64 {
+	var total, dead int64
+	for _, seg := range segments {
+		total += seg.size
+		dead += seg.deadBytes
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(dead) / float64(total)
+}
+
+// maybeCompact starts a background merge if the policy asks for one and
+// no merge is running yet. The caller must hold writeMutex.
+func (db *Db) maybeCompact() {
+	if !db.needsCompaction() || !db.mergeMutex.TryLock() {
+		return
+	}
+	go func() {
+		defer db.mergeMutex.Unlock()
+		if err := db.merge(); err != nil {
+			log.Printf("datastore: merge failed: %s", err)
+		}
+	}()
+}
+
+func (db *Db) compactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.writeMutex.Lock()
+			var due bool
+			if db.out != nil {
+				sealed := db.segments[:len(db.segments)-1]
+				due = len(sealed) > 1 || garbageRatio(sealed) > 0
+			}
+			db.writeMutex.Unlock()
+
+			if due {
+				if err := db.mergeSegments(); err != nil {
+					log.Printf("datastore: scheduled merge failed: %s", err)
+				}
+			}
+		case <-db.writerDone:
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForMerge blocks until a merge started by the last write is done.
+func waitForMerge(db *Db) {
+	db.mergeMutex.Lock()
+	db.mergeMutex.Unlock()
+}
+
+func sealedCount(db *Db) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.segments) - 1
+}
+
+func TestCompactionPolicy(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		db, err := Open(t.TempDir(), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 30; i++ {
+			if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitForMerge(db)
+		if n := sealedCount(db); n < 5 {
+			t.Errorf("Expected segments to pile up without a policy, got %d sealed", n)
+		}
+	})
+
+	t.Run("sealed segments", func(t *testing.T) {
+		db, err := Open(t.TempDir(), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{MaxSealedSegments: 3}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 30; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+			waitForMerge(db)
+			if n := sealedCount(db); n > 3 {
+				t.Fatalf("Expected at most 3 sealed segments, got %d", n)
+			}
+		}
+		for i := 0; i < 30; i++ {
+			if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != "value" {
+				t.Errorf("Get(key%d) = %q (%v)", i, value, err)
+			}
+		}
+	})
+
+	t.Run("garbage ratio", func(t *testing.T) {
+		db, err := Open(t.TempDir(), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{MaxGarbageRatio: 0.5}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 30; i++ {
+			if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+			waitForMerge(db)
+			db.writeMutex.Lock()
+			ratio := garbageRatio(db.segments[:len(db.segments)-1])
+			db.writeMutex.Unlock()
+			if ratio > 0.5 {
+				t.Fatalf("Expected garbage ratio to stay below 0.5, got %.2f", ratio)
+			}
+		}
+		if value, err := db.Get("key"); err != nil || value != "value29" {
+			t.Errorf("Expected 'value29', got %q (%v)", value, err)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		policy := CompactionPolicy{Interval: 10 * time.Millisecond}
+		db, err := Open(t.TempDir(), WithMaxSize(100), WithCompactionPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for sealedCount(db) > 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the timer to merge the sealed segments, got %d", sealedCount(db))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestCompactLeavesActiveSegment(t *testing.T) {
+	db, err := Open(t.TempDir(), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	active, size := db.out, db.out.size
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.segments) != 2 || db.out != active || db.out.size != size {
+		t.Errorf("Expected one merged segment in front of the untouched active segment")
+	}
+	if db.segments[0].deadBytes != 0 {
+		t.Errorf("Expected no dead bytes in the merged segment, got %d", db.segments[0].deadBytes)
+	}
+	for key, expected := range map[string]string{"key0": "value9", "key1": "value7", "key2": "value8"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Get(%q) = %q (%v), wanted %q", key, value, err, expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func compressValue(value string) string {
+	var buf bytes.Buffer
+	// Writes to a bytes.Buffer do not fail, and neither does the writer
+	// at a valid level.
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	io.WriteString(w, value)
+	w.Close()
+	return buf.String()
+}
+
+// decompress replaces a compressed value with the actual one.
+func (e *entry) decompress() error {
+	if !e.compressed {
+		return nil
+	}
+	r := flate.NewReader(strings.NewReader(e.value))
+	defer r.Close()
+	value, err := io.ReadAll(io.LimitReader(r, maxRecordSize+1))
+	if err != nil {
+		return fmt.Errorf("%w: bad compressed value of %q: %s", ErrCorrupted, e.key, err)
+	}
+	if len(value) > maxRecordSize {
+		return fmt.Errorf("%w: compressed value of %q is too large", ErrCorrupted, e.key)
+	}
+	e.value, e.compressed = string(value), false
+	return nil
+}
+
+// compress stores the value of e compressed if it is at least as long as
+// the compression threshold and compression makes it shorter.
+func (db *Db) compress(e *entry) {
+	if db.compressAt <= 0 || e.compressed || e.tombstone || e.valueType != TypeString || len(e.value) < db.compressAt {
+		return
+	}
+	value := compressValue(e.value)
+	if len(value) >= len(e.value) {
+		return
+	}
+	db.uncompressedBytes.Add(int64(len(e.value)))
+	db.compressedBytes.Add(int64(len(value)))
+	e.value, e.compressed = value, true
+}
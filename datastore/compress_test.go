@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	large := func(i int) string {
+		return strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"record"},`, i), 40)
+	}
+	opts := []Option{WithMaxSize(4096), WithCompression(100), WithCompactionPolicy(CompactionPolicy{}), WithReplicationLog(100)}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%02d", i), large(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("small", "short"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap("key00", large(0), large(100)); err != nil {
+		t.Errorf("Expected CompareAndSwap to compare the actual value, got %v", err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		if v, err := db.Get("key00"); err != nil || v != large(100) {
+			t.Errorf("Get(key00) = %.20q (%v), wanted the swapped value", v, err)
+		}
+		for i := 1; i < 20; i++ {
+			if v, err := db.Get(fmt.Sprintf("key%02d", i)); err != nil || v != large(i) {
+				t.Fatalf("Get(key%02d) = %.20q (%v)", i, v, err)
+			}
+		}
+		if v, err := db.Get("small"); err != nil || v != "short" {
+			t.Errorf("Get(small) = %q (%v), wanted short", v, err)
+		}
+		it := db.ScanPrefix("key01")
+		if !it.Next() || it.Value() != large(1) {
+			t.Errorf("Expected the scan to return the actual value of key01")
+		}
+		it.Close()
+	}
+	check(db)
+
+	s := db.Stats()
+	if s.CompressedBytes == 0 || s.CompressionRatio <= 0 || s.CompressionRatio > 0.5 {
+		t.Errorf("Expected repetitive values to compress well, got %+v", s)
+	}
+	if s.TotalBytes > int64(20*len(large(0))/2) {
+		t.Errorf("Expected the segments to be smaller than the values, got %d bytes", s.TotalBytes)
+	}
+
+	// Followers get the compressed records and read them as they are.
+	follower, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	data, _, err := db.ReadLog(LogPosition{Epoch: db.Position().Epoch}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Apply(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	check(follower)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values stay readable without compression, and merges keep them
+	// compressed.
+	db, err = Open(dir, WithMaxSize(4096), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if s := db.Stats(); s.TotalBytes > int64(20*len(large(0))/2) {
+		t.Errorf("Expected merged segments to stay compressed, got %d bytes", s.TotalBytes)
+	}
+	db.Close()
+
+	if _, err := Open(t.TempDir(), WithCompression(-1)); err == nil {
+		t.Error("Expected a negative threshold to be rejected")
+	}
+}
+
+func TestCompressionOnMerge(t *testing.T) {
+	dir := t.TempDir()
+	value := strings.Repeat("abcdefgh", 64)
+	db, err := Open(dir, WithMaxSize(2048), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		if err := db.Put(fmt.Sprintf("key%02d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := db.Stats().TotalBytes
+	db.Close()
+
+	// Merges compress the records written before compression was enabled.
+	db, err = Open(dir, WithMaxSize(2048), WithCompression(100), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s := db.Stats()
+	if s.CompressedBytes == 0 || s.TotalBytes >= before/2 {
+		t.Errorf("Expected the merge to compress the values, %d of %d bytes left", s.TotalBytes, before)
+	}
+	for i := 0; i < 12; i++ {
+		if v, err := db.Get(fmt.Sprintf("key%02d", i)); err != nil || v != value {
+			t.Errorf("Get(key%02d) = %.20q (%v)", i, v, err)
+		}
+	}
+}
+
+func TestCompressedEntry(t *testing.T) {
+	value := strings.Repeat("x", 1000)
+	e := entry{key: "k", value: compressValue(value), compressed: true}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.compressed {
+		t.Fatal("Expected the compressed flag to survive encoding")
+	}
+	if err := decoded.decompress(); err != nil || decoded.value != value {
+		t.Errorf("decompress = %d bytes (%v), wanted the original value", len(decoded.value), err)
+	}
+
+	bad := entry{key: "k", value: "not flate", compressed: true}
+	if err := bad.decompress(); err == nil {
+		t.Error("Expected a bad compressed value to be reported")
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,36 +19,129 @@ const (
 	segmentPrefix  = "segment-"
 	defaultMaxSize = 10 * 1024 * 1024
 	workerPoolSize = 10
+	maxWriteBatch  = 1024
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrExists   = fmt.Errorf("record already exists")
+	ErrConflict = fmt.Errorf("record does not have the expected value")
+	// ErrTypeMismatch is returned when a value is read or compared as a
+	// different type than it was stored with.
+	ErrTypeMismatch = fmt.Errorf("record has a different type")
+	ErrOverflow     = fmt.Errorf("increment overflows int64")
+	// ErrRecordTooLarge is returned for a write whose record would exceed
+	// the largest size a record can have.
+	ErrRecordTooLarge = fmt.Errorf("record is too large")
+)
 
 type segment struct {
+	fs       FS
 	id       int
-	file     *os.File
+	file     File
 	filePath string
+	format   byte
 	size     int64
-	index    map[string]int64
+	index    map[string]recordInfo
+
+	// filter, if set, holds the keys of index. While a segment is
+	// recovered with a persisted filter, filterComplete skips adding to it.
+	filter         *bloomFilter
+	filterComplete bool
+
+	// records counts every record in the segment, liveKeys those the
+	// index points at. The bytes of all the others are deadBytes.
+	records   int64
+	liveKeys  int64
+	deadBytes int64
+
+	// refs counts the Db itself and every read in flight. Once a merge
+	// retires the segment, the last reference removes its files.
+	refs atomic.Int32
+}
+
+func newSegment(fsys FS, id int, file File, filePath string, size int64) *segment {
+	seg := &segment{
+		fs:       fsys,
+		id:       id,
+		file:     file,
+		filePath: filePath,
+		format:   currentFormat,
+		size:     size,
+		index:    make(map[string]recordInfo),
+	}
+	seg.refs.Store(1)
+	return seg
+}
+
+func (seg *segment) acquire() {
+	seg.refs.Add(1)
+}
+
+func (seg *segment) release() {
+	if seg.refs.Add(-1) == 0 {
+		seg.file.Close()
+		seg.fs.Remove(seg.filePath)
+		seg.fs.Remove(hintPath(seg.filePath))
+		seg.fs.Remove(bloomPath(seg.filePath))
+	}
 }
 
 type Db struct {
+	fs         FS
 	mu         sync.RWMutex
 	writeMutex sync.Mutex
+	mergeMutex sync.Mutex
 	writeChan  chan writeRequest
 	out        *segment
 	segments   []*segment
-	index      map[string]segmentLocation
+	index      keyIndex
+	indexKind  IndexKind
+	cache      *valueCache
+	bloomRate  float64
+	// compressAt is the length from which string values are stored
+	// compressed, 0 if they are not.
+	compressAt int
 	maxSize    int64
+	syncPolicy SyncPolicy
+	compaction CompactionPolicy
+	maxBatch   int
+	dirty      bool
+	indexBuf   int
 	dir        string
 	nextSegID  int
 	workerPool chan workerRequest
 	writerDone chan struct{}
 	closeOnce  sync.Once
+	now        func() time.Time
+
+	bloomNegatives      atomic.Int64
+	bloomFalsePositives atomic.Int64
+
+	uncompressedBytes atomic.Int64
+	compressedBytes   atomic.Int64
+
+	mergeCount        int
+	lastMerge         time.Time
+	lastMergeDuration time.Duration
+
+	// epoch and seq are the position of the last written record in the
+	// replication log, which keeps up to replLogSize recent records.
+	epoch       string
+	seq         uint64
+	replLog     []logRecord
+	replLogSize int
+
+	// interrupt, if set, is asked before every step of a merge whether to
+	// stop right there, leaving the files as a crash at that point would.
+	interrupt func(step string) bool
 }
 
 type segmentLocation struct {
-	segID  int
-	offset int64
+	segID     int
+	offset    int64
+	size      int64
+	expiresAt int64
 }
 
 type workerRequest struct {
@@ -53,37 +149,69 @@ type workerRequest struct {
 	segID    int
 	offset   int64
 	filePath string
+	format   byte
 	result   chan workerResponse
 }
 
 type workerResponse struct {
-	value string
-	err   error
+	record entry
+	err    error
 }
 
 type writeRequest struct {
-	key   string
-	value string
-	err   chan error
+	key       string
+	value     string
+	valueType ValueType
+	tombstone bool
+	expiresAt int64
+	ifAbsent  bool
+	expected  *string
+	batch     *Batch
+	increment bool
+	delta     int64
+	result    *int64
+	err       chan error
+
+	// compressed is set when value has been compressed already.
+	compressed bool
 }
 
-func Open(dir string) (*Db, error) {
-	return OpenWithMaxSize(dir, defaultMaxSize)
-}
+func Open(dir string, opts ...Option) (*Db, error) {
+	o := newOptions(opts)
+	if o.bloomRate < 0 || o.bloomRate >= 1 {
+		return nil, fmt.Errorf("bloom filter false positive rate must be in [0, 1), got %g", o.bloomRate)
+	}
+	if o.compressAbove < 0 {
+		return nil, fmt.Errorf("compression threshold must not be negative, got %d", o.compressAbove)
+	}
 
-func OpenWithMaxSize(dir string, maxSize int64) (*Db, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := o.fs.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
+	if _, err := o.fs.Stat(filepath.Join(dir, lsmManifestName)); err == nil {
+		return nil, fmt.Errorf("%s holds an LSM store", dir)
+	}
 
 	db := &Db{
-		index:      make(map[string]segmentLocation),
-		maxSize:    maxSize,
+		fs:         o.fs,
+		indexKind:  o.index,
+		indexBuf:   o.indexBuffer,
+		cache:      newValueCache(o.cacheSize),
+		bloomRate:  o.bloomRate,
+		compressAt: o.compressAbove,
+		maxSize:    o.maxSize,
+		syncPolicy: o.syncPolicy,
+		compaction: o.compaction,
+		maxBatch:   maxWriteBatch,
 		dir:        dir,
 		segments:   make([]*segment, 0),
 		workerPool: make(chan workerRequest, workerPoolSize),
 		writeChan:  make(chan writeRequest),
 		writerDone: make(chan struct{}),
+		now:        time.Now,
+
+		epoch:       newEpoch(),
+		replLogSize: o.replicationLog,
 	}
 
 	for i := 0; i < workerPoolSize; i++ {
@@ -97,26 +225,100 @@ func OpenWithMaxSize(dir string, maxSize int64) (*Db, error) {
 		return nil, err
 	}
 
+	if db.syncPolicy == SyncInterval {
+		go db.syncer(o.syncInterval)
+	}
+	if db.compaction.Interval > 0 {
+		go db.compactor(db.compaction.Interval)
+	}
+
 	return db, nil
 }
 
+func OpenWithMaxSize(dir string, maxSize int64) (*Db, error) {
+	return Open(dir, WithMaxSize(maxSize))
+}
+
 func (db *Db) writer() {
 	for {
 		select {
 		case req := <-db.writeChan:
+			reqs := []writeRequest{req}
+			if db.syncPolicy != SyncAlways {
+				reqs = db.collectWrites(reqs)
+			}
+
 			db.writeMutex.Lock()
-			err := db.doPut(req.key, req.value)
-			req.err <- err
+			var errs []error
+			select {
+			case <-db.writerDone:
+				// Close got the lock first and the segments are closed.
+				errs = make([]error, len(reqs))
+				for i := range errs {
+					errs[i] = errClosed
+				}
+			default:
+				errs = db.applyWrites(reqs)
+			}
 			db.writeMutex.Unlock()
+
+			for i, req := range reqs {
+				req.err <- errs[i]
+			}
 		case <-db.writerDone:
 			return
 		}
 	}
 }
 
+// collectWrites picks up the writes other callers are already waiting to
+// submit, so that they can share a single write and fsync.
+func (db *Db) collectWrites(reqs []writeRequest) []writeRequest {
+	for len(reqs) < db.maxBatch {
+		select {
+		case req := <-db.writeChan:
+			reqs = append(reqs, req)
+		default:
+			return reqs
+		}
+	}
+	return reqs
+}
+
+func (db *Db) syncer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.writeMutex.Lock()
+			if db.out != nil {
+				if err := db.syncOut(); err != nil {
+					log.Printf("datastore: periodic sync of %s failed: %s", db.out.filePath, err)
+				}
+			}
+			db.writeMutex.Unlock()
+		case <-db.writerDone:
+			return
+		}
+	}
+}
+
+func (db *Db) syncOut() error {
+	if !db.dirty {
+		return nil
+	}
+	if err := db.out.file.Sync(); err != nil {
+		return err
+	}
+	db.dirty = false
+	return nil
+}
+
 func (db *Db) worker() {
 	for req := range db.workerPool {
-		file, err := os.Open(req.filePath)
+		file, err := openFile(db.fs, req.filePath)
 		if err != nil {
 			req.result <- workerResponse{err: err}
 			continue
@@ -132,51 +334,74 @@ func (db *Db) worker() {
 			}
 
 			var record entry
-			_, err = record.DecodeFromReader(bufio.NewReader(file))
+			_, err = record.decodeFromReader(bufio.NewReader(file), req.format)
+			if err == nil {
+				err = record.decompress()
+			}
 			if err != nil {
 				req.result <- workerResponse{err: err}
 				return
 			}
 
-			req.result <- workerResponse{value: record.value}
+			req.result <- workerResponse{record: record}
 		}()
 	}
 }
 
 func (db *Db) recover() error {
-	files, err := os.ReadDir(db.dir)
+	names, err := readManifest(db.fs, db.dir)
+	hasManifest := err == nil
+	if errors.Is(err, os.ErrNotExist) {
+		names, err = listSegmentFiles(db.fs, db.dir)
+	}
 	if err != nil {
 		return err
 	}
-	var segFiles []struct {
-		name string
-		id   int
+
+	live := make(map[string]bool)
+	for _, name := range names {
+		live[name] = true
+	}
+	if err := removeUnlisted(db.fs, db.dir, live); err != nil {
+		return err
+	}
+	if db.index, err = db.newIndex(); err != nil {
+		return err
+	}
+	if err := db.openSegments(names); err != nil {
+		return err
+	}
+	if err := db.index.Err(); err != nil {
+		return err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
+	if len(db.segments) == 0 {
+		return db.createNewSegment()
+	}
 
-		var id int
-		if file.Name() == outFileName {
-			id = 0
-		} else if _, err := fmt.Sscanf(file.Name(), segmentPrefix+"%d", &id); err != nil {
-			continue
-		}
-		segFiles = append(segFiles, struct {
-			name string
-			id   int
-		}{name: file.Name(), id: id})
+	db.out = db.segments[len(db.segments)-1]
+	if db.out.format != currentFormat {
+		return db.createNewSegment()
+	}
+	if !hasManifest {
+		return writeManifest(db.fs, db.dir, db.segments)
 	}
+	return nil
+}
 
-	sort.Slice(segFiles, func(i, j int) bool {
-		return segFiles[i].id < segFiles[j].id
-	})
+func (db *Db) newIndex() (keyIndex, error) {
+	if db.indexKind == IndexDisk {
+		return newDiskIndex(db.fs, db.dir, db.indexBuf)
+	}
+	return newMemIndex(), nil
+}
 
-	for _, sf := range segFiles {
-		segPath := filepath.Join(db.dir, sf.name)
-		f, err := os.OpenFile(segPath, os.O_RDWR|os.O_CREATE, 0600)
+// openSegments opens the named segments, oldest first, and indexes them.
+func (db *Db) openSegments(names []string) error {
+	for i, name := range names {
+		id, _ := parseSegmentName(name)
+		segPath := filepath.Join(db.dir, name)
+		f, err := db.fs.OpenFile(segPath, os.O_APPEND|os.O_RDWR, 0600)
 		if err != nil {
 			return err
 		}
@@ -187,61 +412,215 @@ func (db *Db) recover() error {
 			return err
 		}
 
-		seg := &segment{
-			id:       sf.id,
-			file:     f,
-			filePath: segPath,
-			size:     info.Size(),
-			index:    make(map[string]int64),
-		}
-
+		seg := newSegment(db.fs, id, f, segPath, info.Size())
 		db.segments = append(db.segments, seg)
-		if sf.id >= db.nextSegID {
-			db.nextSegID = sf.id + 1
+		if id >= db.nextSegID {
+			db.nextSegID = id + 1
 		}
 
-		if err := db.recoverSegmentIndex(seg); err != nil {
+		db.loadFilter(seg)
+		err = db.recoverSegmentIndex(seg)
+		seg.filterComplete = false
+		if err != nil {
 			return err
 		}
-	}
+		if i < len(names)-1 {
+			db.sealIndex(seg)
+		}
 
-	if len(db.segments) == 0 {
-		if err := db.createNewSegment(); err != nil {
-			return err
+		if seg.size == 0 {
+			seg.format = currentFormat
+			if err := writeSegmentHeader(seg); err != nil {
+				return err
+			}
 		}
-	} else {
-		db.out = db.segments[len(db.segments)-1]
 	}
-
 	return nil
 }
 
+// listSegmentFiles finds the segments of a database written before the
+// manifest existed, ordered by id.
+func listSegmentFiles(fsys FS, dir string) ([]string, error) {
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if _, ok := parseSegmentName(file.Name()); ok && !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := parseSegmentName(names[i])
+		b, _ := parseSegmentName(names[j])
+		return a < b
+	})
+	return names, nil
+}
+
 func (db *Db) recoverSegmentIndex(seg *segment) error {
-	file, err := os.Open(seg.filePath)
+	file, err := openFile(db.fs, seg.filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
 	in := bufio.NewReader(file)
-	var offset int64 = 0
+	format, headerSize, err := readSegmentHeader(in)
+	if errors.Is(err, errTornHeader) {
+		return db.truncateSegment(seg, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", seg.filePath, err)
+	}
+	seg.format = format
+	offset := int64(headerSize)
+
+	// The hint only has the last record of each key, everything else it
+	// covers has been overwritten.
+	db.mu.Lock()
+	var hinted int64
+	covered, records, err := readHint(seg, func(h hintEntry) {
+		hinted++
+		seg.deadBytes -= h.size
+		db.indexLocked(seg, h.key, h.recordInfo)
+	})
+	if err == nil {
+		seg.records += records - hinted
+		seg.deadBytes += covered - offset
+	}
+	db.mu.Unlock()
+	if err == nil {
+		offset = covered
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		in.Reset(file)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("datastore: ignoring hint for %s: %s", seg.filePath, err)
+	}
+
+	// Records of a batch are only indexed once its last record is read, so
+	// that a batch cut short by a crash is discarded as a whole.
+	var batch []hintEntry
+	batchStart := offset
 
 	for {
 		var record entry
-		n, err := record.DecodeFromReader(in)
+		n, err := record.decodeFromReader(in, seg.format)
 		if errors.Is(err, io.EOF) {
+			if len(batch) > 0 {
+				return db.truncateSegment(seg, batchStart)
+			}
 			break
 		}
+		if isTornRecord(err, offset+int64(n), seg.size) {
+			return db.truncateSegment(seg, batchStart)
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("segment %s at offset %d: %w", seg.filePath, offset, err)
 		}
 
-		seg.index[record.key] = offset
-		db.mu.Lock()
-		db.index[record.key] = segmentLocation{segID: seg.id, offset: offset}
-		db.mu.Unlock()
+		batch = append(batch, hintEntry{
+			key: record.key,
+			recordInfo: recordInfo{
+				offset:    offset,
+				size:      int64(n),
+				tombstone: record.tombstone,
+				expiresAt: record.expiresAt,
+			},
+		})
 		offset += int64(n)
+
+		if !record.continued {
+			db.mu.Lock()
+			for _, h := range batch {
+				db.indexLocked(seg, h.key, h.recordInfo)
+			}
+			db.mu.Unlock()
+			batch = batch[:0]
+			batchStart = offset
+		}
+	}
+	return nil
+}
+
+func (db *Db) segmentByID(id int) *segment {
+	for _, seg := range db.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (loc segmentLocation) expired(now time.Time) bool {
+	return loc.expiresAt != 0 && now.UnixNano() >= loc.expiresAt
+}
+
+func (db *Db) indexRecord(seg *segment, key string, info recordInfo) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.indexLocked(seg, key, info)
+}
+
+func (db *Db) indexLocked(seg *segment, key string, info recordInfo) {
+	var loc segmentLocation
+	var ok bool
+	if info.tombstone {
+		loc, ok = db.index.Delete(key)
+	} else {
+		loc, ok = db.index.Set(key, segmentLocation{segID: seg.id, offset: info.offset, size: info.size, expiresAt: info.expiresAt})
+	}
+	if ok {
+		if prev := db.segmentByID(loc.segID); prev != nil {
+			prev.deadBytes += loc.size
+			prev.liveKeys--
+		}
+	}
+	seg.records++
+	if info.tombstone {
+		seg.deadBytes += info.size
+	} else {
+		seg.liveKeys++
+	}
+
+	seg.index[key] = info
+	if !info.tombstone {
+		db.addToFilter(seg, key)
+	}
+	db.cache.remove(key)
+}
+
+// sealIndex drops the index of a sealed segment when the keys are to be
+// kept on disk, as its hint has them too. Only the active segment, which
+// is bounded by the maximum segment size, keeps its keys in memory.
+func (db *Db) sealIndex(seg *segment) {
+	if db.indexKind == IndexDisk {
+		seg.index = nil
+	}
+}
+
+// A record is torn if the segment ends in the middle of it, or if it is
+// the last record in the segment and fails validation. Anything else is
+// corruption that recovery must not silently drop.
+func isTornRecord(err error, end, segSize int64) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return errors.Is(err, ErrCorrupted) && end == segSize
+}
+
+// truncateSegment cuts off torn data during recovery, before seg is
+// shared with readers.
+func (db *Db) truncateSegment(seg *segment, size int64) error {
+	if err := seg.file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate segment %s: %w", seg.filePath, err)
 	}
+	log.Printf("datastore: discarded %d bytes of torn data at the end of %s", seg.size-size, seg.filePath)
+	seg.size = size
 	return nil
 }
 
@@ -249,42 +628,98 @@ func (db *Db) createNewSegment() error {
 	var segPath string
 	var id int
 
+	if db.out != nil {
+		if db.syncPolicy != SyncNever {
+			if err := db.syncOut(); err != nil {
+				return err
+			}
+		}
+		if err := writeHint(db.out); err != nil {
+			log.Printf("datastore: failed to write hint for %s: %s", db.out.filePath, err)
+		}
+		if err := writeFilter(db.out); err != nil {
+			log.Printf("datastore: failed to write filter for %s: %s", db.out.filePath, err)
+		}
+	}
+
 	if len(db.segments) == 0 {
 		segPath = filepath.Join(db.dir, outFileName)
 		id = 0
+		db.nextSegID = max(db.nextSegID, 1)
 	} else {
 		segPath = filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentPrefix, db.nextSegID))
 		id = db.nextSegID
 		db.nextSegID++
 	}
 
-	f, err := os.OpenFile(segPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	db.fs.Remove(hintPath(segPath))
+	db.fs.Remove(bloomPath(segPath))
+	f, err := db.fs.OpenFile(segPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
 
-	seg := &segment{
-		id:       id,
-		file:     f,
-		filePath: segPath,
-		size:     0,
-		index:    make(map[string]int64),
+	seg := newSegment(db.fs, id, f, segPath, 0)
+	seg.filter = db.newFilter()
+	if err := writeSegmentHeader(seg); err != nil {
+		f.Close()
+		return err
+	}
+	if db.syncPolicy != SyncNever {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := db.fs.SyncDir(db.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	segments := append(db.segments[:len(db.segments):len(db.segments)], seg)
+	if err := writeManifest(db.fs, db.dir, segments); err != nil {
+		f.Close()
+		db.fs.Remove(segPath)
+		return err
 	}
 
-	db.segments = append(db.segments, seg)
+	db.mu.Lock()
+	if db.out != nil {
+		db.sealIndex(db.out)
+	}
+	db.segments = segments
 	db.out = seg
+	db.mu.Unlock()
 
 	return nil
 }
 
+// writeSegmentHeader starts a new segment, which is not shared with
+// readers yet. Once it is, its size only changes under mu.
+func writeSegmentHeader(seg *segment) error {
+	n, err := seg.file.Write(encodeSegmentHeader(seg.format))
+	seg.size += int64(n)
+	return err
+}
+
 func (db *Db) Close() error {
 	var firstErr error
 	db.closeOnce.Do(func() {
+		db.mergeMutex.Lock()
+		defer db.mergeMutex.Unlock()
+
 		close(db.writerDone)
-		close(db.workerPool)
 
+		// A write under way may still read records through the workers.
 		db.writeMutex.Lock()
 		defer db.writeMutex.Unlock()
+		close(db.workerPool)
+
+		if db.out != nil && db.syncPolicy != SyncNever {
+			if err := db.syncOut(); err != nil {
+				firstErr = fmt.Errorf("failed to sync segment %s: %w", db.out.filePath, err)
+			}
+		}
 
 		for _, seg := range db.segments {
 			if seg.file != nil {
@@ -294,6 +729,12 @@ func (db *Db) Close() error {
 			}
 		}
 
+		if db.index != nil {
+			if err := db.index.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
 		db.segments = nil
 		db.out = nil
 	})
@@ -302,26 +743,54 @@ func (db *Db) Close() error {
 }
 
 func (db *Db) Get(key string) (string, error) {
-	db.mu.RLock()
-	loc, ok := db.index[key]
-	db.mu.RUnlock()
+	record, err := db.getEntry(key)
+	if err != nil {
+		return "", err
+	}
+	if record.valueType != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return record.value, nil
+}
 
-	if !ok {
-		return "", ErrNotFound
+func (db *Db) GetInt64(key string) (int64, error) {
+	record, err := db.getEntry(key)
+	if err != nil {
+		return 0, err
 	}
+	if record.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return record.int64(), nil
+}
 
+func (db *Db) getEntry(key string) (entry, error) {
 	db.mu.RLock()
+	loc, ok := db.lookupLocked(key)
+	ierr := db.index.Err()
 	var seg *segment
-	for _, s := range db.segments {
-		if s.id == loc.segID {
-			seg = s
-			break
-		}
+	if ok {
+		seg = db.segmentByID(loc.segID)
+	}
+	if seg != nil {
+		seg.acquire()
 	}
 	db.mu.RUnlock()
 
+	if seg != nil {
+		defer seg.release()
+	}
+	if ierr != nil {
+		return entry{}, ierr
+	}
+	if !ok || loc.expired(db.now()) {
+		return entry{}, ErrNotFound
+	}
 	if seg == nil {
-		return "", fmt.Errorf("segment %d not found", loc.segID)
+		return entry{}, fmt.Errorf("segment %d not found", loc.segID)
+	}
+	if record, ok := db.cache.get(key, loc); ok {
+		return record, nil
 	}
 
 	resultChan := make(chan workerResponse, 1)
@@ -330,148 +799,572 @@ func (db *Db) Get(key string) (string, error) {
 		segID:    loc.segID,
 		offset:   loc.offset,
 		filePath: seg.filePath,
+		format:   seg.format,
 		result:   resultChan,
 	}
 
 	resp := <-resultChan
-	return resp.value, resp.err
+	if resp.err == nil {
+		db.cache.add(key, loc, resp.record)
+	}
+	return resp.record, resp.err
 }
 
-func (db *Db) doPut(key, value string) error {
-	e := entry{
-		key:   key,
-		value: value,
+func (db *Db) applyWrites(reqs []writeRequest) []error {
+	errs := make([]error, len(reqs))
+	entries := make([]entry, 0, len(reqs))
+	owners := make([]int, 0, len(reqs))
+
+	// queued holds the last entry of every key written earlier in this
+	// group, which later requests must observe instead of the index.
+	queued := make(map[string]entry)
+	now := db.now()
+	current := func(key string) (entry, error) {
+		if e, ok := queued[key]; ok {
+			if e.tombstone || e.expired(now) {
+				return entry{}, ErrNotFound
+			}
+			// Values are compressed before they are queued.
+			err := e.decompress()
+			return e, err
+		}
+		return db.getEntry(key)
+	}
+	// find is like current without reading the record.
+	find := func(key string) error {
+		if e, ok := queued[key]; ok {
+			if e.tombstone || e.expired(now) {
+				return ErrNotFound
+			}
+			return nil
+		}
+		db.mu.RLock()
+		loc, ok := db.lookupLocked(key)
+		db.mu.RUnlock()
+		if !ok || loc.expired(now) {
+			return ErrNotFound
+		}
+		return nil
 	}
-	data := e.Encode()
 
-	if db.out.size+int64(len(data)) > db.maxSize {
-		if err := db.createNewSegment(); err != nil {
-			return err
+	for i, req := range reqs {
+		if req.batch != nil {
+			var batch []entry
+			for _, op := range req.batch.ops {
+				if op.tombstone && find(op.key) != nil {
+					continue
+				}
+				e := op
+				e.continued = true
+				queued[op.key] = e
+				batch = append(batch, e)
+			}
+			if len(batch) > 0 {
+				batch[len(batch)-1].continued = false
+			}
+			for _, e := range batch {
+				entries = append(entries, e)
+				owners = append(owners, i)
+			}
+			continue
 		}
+
+		if req.tombstone {
+			if err := find(req.key); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		if req.ifAbsent {
+			if err := checkAbsent(find(req.key)); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		if req.increment {
+			cur, err := current(req.key)
+			next, n, err := applyIncrement(req.key, cur, err, req.delta)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			*req.result = n
+			req.value, req.valueType, req.expiresAt = next.value, next.valueType, next.expiresAt
+		}
+		if req.expected != nil {
+			cur, err := current(req.key)
+			if err := checkSwap(cur, err, *req.expected); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		e := entry{key: req.key, value: req.value, valueType: req.valueType, tombstone: req.tombstone, compressed: req.compressed, expiresAt: req.expiresAt}
+		queued[req.key] = e
+		entries = append(entries, e)
+		owners = append(owners, i)
 	}
 
-	n, err := db.out.file.Write(data)
+	if len(entries) == 0 {
+		return errs
+	}
+
+	written, err := db.appendEntries(entries)
+	if err == nil && (db.syncPolicy == SyncAlways || db.syncPolicy == SyncBatch) {
+		err = db.syncOut()
+		written = 0
+	}
 	if err != nil {
-		return err
+		for _, i := range owners[written:] {
+			errs[i] = err
+		}
 	}
 
-	db.mu.Lock()
-	db.out.index[key] = db.out.size
-	db.index[key] = segmentLocation{segID: db.out.id, offset: db.out.size}
-	db.mu.Unlock()
+	db.maybeCompact()
 
-	db.out.size += int64(n)
+	return errs
+}
 
-	if len(db.segments) > 1 {
-		go db.mergeSegments()
+// appendEntries writes the entries with as few writes as possible and
+// indexes them. It returns how many entries were written before an error.
+func (db *Db) appendEntries(entries []entry) (int, error) {
+	var buf []byte
+	var pending []entry
+	var infos []recordInfo
+	written := 0
+
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		size := db.out.size
+		n, err := db.out.file.Write(buf)
+		if n > 0 {
+			db.dirty = true
+		}
+		if err != nil {
+			if n > 0 {
+				if terr := db.out.file.Truncate(size); terr != nil {
+					log.Printf("datastore: failed to discard partial write to %s: %s", db.out.filePath, terr)
+				}
+			}
+			return err
+		}
+
+		db.mu.Lock()
+		db.out.size += int64(n)
+		for i, e := range pending {
+			db.indexLocked(db.out, e.key, infos[i])
+		}
+		db.logLocked(pending, infos, buf, size)
+		ierr := db.index.Err()
+		db.mu.Unlock()
+		if ierr != nil {
+			return ierr
+		}
+
+		written += len(pending)
+		buf, pending, infos = buf[:0], pending[:0], infos[:0]
+		return nil
 	}
 
-	return nil
+	for _, e := range entries {
+		data := e.Encode()
+
+		inBatch := len(pending) > 0 && pending[len(pending)-1].continued
+		if !inBatch && db.out.size+int64(len(buf)+len(data)) > db.maxSize && db.out.size+int64(len(buf)) > segmentHeaderSize {
+			if err := flush(); err != nil {
+				return written, err
+			}
+			if err := db.createNewSegment(); err != nil {
+				return written, err
+			}
+		}
+
+		infos = append(infos, recordInfo{
+			offset:    db.out.size + int64(len(buf)),
+			size:      int64(len(data)),
+			tombstone: e.tombstone,
+			expiresAt: e.expiresAt,
+		})
+		pending = append(pending, e)
+		buf = append(buf, data...)
+	}
+
+	return written, flush()
 }
 
 func (db *Db) Put(key, value string) error {
-	errChan := make(chan error, 1)
-	db.writeChan <- writeRequest{
-		key:   key,
-		value: value,
-		err:   errChan,
+	return db.submit(writeRequest{key: key, value: value})
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	e := int64Entry(key, value)
+	return db.submit(writeRequest{key: key, value: e.value, valueType: TypeInt64})
+}
+
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	var n int64
+	if err := db.submit(writeRequest{key: key, increment: true, delta: delta, result: &n}); err != nil {
+		return 0, err
 	}
-	return <-errChan
+	return n, nil
+}
+
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return db.submit(writeRequest{key: key, value: value, expiresAt: db.now().Add(ttl).UnixNano()})
+}
+
+func (db *Db) CompareAndSwap(key, expected, value string) error {
+	return db.submit(writeRequest{key: key, value: value, expected: &expected})
+}
+
+func (db *Db) PutIfAbsent(key, value string) error {
+	return db.submit(writeRequest{key: key, value: value, ifAbsent: true})
+}
+
+func (db *Db) submit(req writeRequest) error {
+	if req.batch == nil {
+		e := entry{key: req.key, value: req.value, valueType: req.valueType, tombstone: req.tombstone}
+		if err := e.validate(); err != nil {
+			return err
+		}
+		// Values are compressed by the caller rather than by the single
+		// writer, which would hold up every other write meanwhile.
+		db.compress(&e)
+		req.value, req.compressed = e.value, e.compressed
+	}
+
+	req.err = make(chan error, 1)
+	select {
+	case db.writeChan <- req:
+	case <-db.writerDone:
+		return errClosed
+	}
+	return <-req.err
+}
+
+func (db *Db) WriteBatch(b *Batch) error {
+	for _, op := range b.ops {
+		if err := op.validate(); err != nil {
+			return err
+		}
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	if db.compressAt > 0 {
+		// The ops of b are left as they are for the caller.
+		compressed := &Batch{ops: append([]entry(nil), b.ops...)}
+		for i := range compressed.ops {
+			db.compress(&compressed.ops[i])
+		}
+		b = compressed
+	}
+	return db.submit(writeRequest{batch: b})
+}
+
+func (db *Db) Delete(key string) error {
+	return db.submit(writeRequest{key: key, tombstone: true})
 }
 
-func (db *Db) mergeSegments() {
+func (db *Db) mergeSegments() error {
+	db.mergeMutex.Lock()
+	defer db.mergeMutex.Unlock()
+	return db.merge()
+}
+
+var errMergeInterrupted = fmt.Errorf("merge interrupted")
+
+// relocateChunk is how many keys a merge moves into the merged segment
+// under one hold of the index lock.
+const relocateChunk = 1024
+
+type relocation struct {
+	key  string
+	info recordInfo
+}
+
+// merge rewrites the sealed segments into a single segment holding only
+// the latest live record of each key. Writes go on while the segments are
+// copied; the writer is only held back to switch over to the result.
+//
+// The manifest is the commit point. Until it lists the merged segment, a
+// crash leaves the old segments in charge; afterwards recovery removes
+// them. Old segment files are deleted once no Get is reading them.
+//
+// The caller must hold mergeMutex.
+func (db *Db) merge() (err error) {
+	started := time.Now()
 	db.writeMutex.Lock()
-	defer db.writeMutex.Unlock()
+	if db.out == nil || len(db.segments) <= 1 {
+		db.writeMutex.Unlock()
+		return nil
+	}
+	mergedID := db.nextSegID
+	db.nextSegID++
+	sealed := append([]*segment(nil), db.segments[:len(db.segments)-1]...)
+	merging := make(map[int]bool)
+	for _, seg := range sealed {
+		merging[seg.id] = true
+	}
+	now := db.now()
+	db.writeMutex.Unlock()
 
-	if len(db.segments) <= 1 {
-		return
+	if db.interrupted("copy") {
+		return errMergeInterrupted
 	}
 
-	tempPath := filepath.Join(db.dir, "merge-temp")
-	tempFile, err := os.OpenFile(tempPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	tempPath := filepath.Join(db.dir, mergeTempName)
+	tempFile, err := db.fs.OpenFile(tempPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return
+		return err
 	}
-	defer os.Remove(tempPath)
-	defer tempFile.Close()
-
-	newIndex := make(map[string]segmentLocation)
-	var offset int64 = 0
+	newSegPath := filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentPrefix, mergedID))
+	committed := false
+	defer func() {
+		if !committed && !errors.Is(err, errMergeInterrupted) {
+			tempFile.Close()
+			db.fs.Remove(tempPath)
+			db.fs.Remove(newSegPath)
+			db.fs.Remove(hintPath(newSegPath))
+			db.fs.Remove(bloomPath(newSegPath))
+		}
+	}()
 
-	for i := len(db.segments) - 1; i >= 0; i-- {
-		seg := db.segments[i]
-		file, err := os.Open(seg.filePath)
+	if _, err := tempFile.Write(encodeSegmentHeader(currentFormat)); err != nil {
+		return err
+	}
+	var offset int64 = segmentHeaderSize
+
+	// A record is copied only while the index points at it; anything else
+	// has been overwritten or deleted, possibly in a newer segment. With
+	// the keys on disk, the copied ones are not collected in memory but
+	// read back from the merged segment.
+	var newSegIndex map[string]recordInfo
+	if db.indexKind != IndexDisk {
+		newSegIndex = make(map[string]recordInfo)
+	}
+	var copied int64
+	dropped := make(map[string]segmentLocation)
+	for _, seg := range sealed {
+		err := readSegmentRecords(seg, func(recordOffset, _ int64, record entry) error {
+			db.mu.RLock()
+			loc, ok := db.index.Get(record.key)
+			db.mu.RUnlock()
+			if !ok || loc.segID != seg.id || loc.offset != recordOffset {
+				return nil
+			}
+			if record.expired(now) {
+				dropped[record.key] = loc
+				return nil
+			}
+			record.continued = false
+			// Records written before compression was enabled are
+			// compressed now; compressed ones are copied as they are.
+			db.compress(&record)
+
+			data := record.Encode()
+			if _, err := tempFile.Write(data); err != nil {
+				return err
+			}
+			if newSegIndex != nil {
+				newSegIndex[record.key] = recordInfo{offset: offset, size: int64(len(data)), expiresAt: record.expiresAt}
+			}
+			copied++
+			offset += int64(len(data))
+			return nil
+		})
 		if err != nil {
-			continue
+			return err
 		}
+	}
 
-		reader := bufio.NewReader(file)
-		var segOffset int64 = 0
+	if db.interrupted("sync") {
+		return errMergeInterrupted
+	}
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
 
-		for {
-			var record entry
-			n, err := record.DecodeFromReader(reader)
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if err != nil {
-				file.Close()
-				continue
-			}
+	if db.interrupted("rename") {
+		return errMergeInterrupted
+	}
+	db.fs.Remove(hintPath(newSegPath))
+	db.fs.Remove(bloomPath(newSegPath))
+	if err := db.fs.Rename(tempPath, newSegPath); err != nil {
+		return err
+	}
+	if err := db.fs.SyncDir(db.dir); err != nil {
+		return err
+	}
 
-			if _, exists := newIndex[record.key]; !exists {
-				data := record.Encode()
-				if _, err := tempFile.Write(data); err != nil {
-					file.Close()
-					continue
+	newSegFile, err := db.fs.OpenFile(newSegPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	newSeg := newSegment(db.fs, mergedID, newSegFile, newSegPath, offset)
+	newSeg.index = newSegIndex
+	newSeg.records = copied
+	merged := func(fn func(key string, info recordInfo) error) error {
+		if newSegIndex != nil {
+			for key, info := range newSegIndex {
+				if err := fn(key, info); err != nil {
+					return err
 				}
-
-				newIndex[record.key] = segmentLocation{segID: db.nextSegID, offset: offset}
-				offset += int64(len(data))
 			}
-
-			segOffset += int64(n)
+			return nil
 		}
-		file.Close()
+		return readSegmentRecords(newSeg, func(offset, size int64, record entry) error {
+			return fn(record.key, recordInfo{offset: offset, size: size, expiresAt: record.expiresAt})
+		})
 	}
-
-	for _, seg := range db.segments {
-		seg.file.Close()
+	if herr := writeHintFrom(newSeg, merged); herr != nil {
+		log.Printf("datastore: failed to write hint for %s: %s", newSeg.filePath, herr)
+	}
+	if db.bloomRate != 0 {
+		newSeg.filter = newBloomFilter(copied, db.bloomRate)
+		ferr := merged(func(key string, _ recordInfo) error {
+			newSeg.filter.add(bloomHash(key))
+			return nil
+		})
+		if ferr == nil {
+			ferr = writeFilter(newSeg)
+		}
+		if ferr != nil {
+			newSeg.filter = nil
+			log.Printf("datastore: failed to write filter for %s: %s", newSeg.filePath, ferr)
+		}
 	}
 
-	newSegPath := filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentPrefix, db.nextSegID))
-	if err := os.Rename(tempPath, newSegPath); err != nil {
-		db.recover()
-		return
+	if db.interrupted("install") {
+		newSegFile.Close()
+		return errMergeInterrupted
 	}
 
-	newSegFile, err := os.OpenFile(newSegPath, os.O_RDWR, 0600)
+	// The merged segment joins the others before keys move into it, so
+	// that lookups find either copy of a record while they do. From here
+	// on it is in use and is kept even if the merge fails.
+	committed = true
+	db.writeMutex.Lock()
+	db.mu.Lock()
+	db.segments = append(append(sealed[:len(sealed):len(sealed)], newSeg), db.segments[len(sealed):]...)
+	db.mu.Unlock()
+	db.writeMutex.Unlock()
+
+	// Writes only ever move keys out of the merged segments, so a key the
+	// index still has in one of them points at the record that was copied.
+	// Keys move a chunk at a time, so that reads and writes go on between.
+	var pending []relocation
+	relocate := func() error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for _, r := range pending {
+			if loc, ok := db.index.Get(r.key); ok && merging[loc.segID] {
+				to := segmentLocation{segID: mergedID, offset: r.info.offset, size: r.info.size, expiresAt: r.info.expiresAt}
+				db.index.Set(r.key, to)
+				db.cache.relocate(r.key, loc, to)
+				newSeg.liveKeys++
+			} else {
+				newSeg.deadBytes += r.info.size
+			}
+		}
+		pending = pending[:0]
+		return db.index.Err()
+	}
+	relocateNext := func() error {
+		if err := relocate(); err != nil {
+			return err
+		}
+		if db.interrupted("relocate") {
+			return errMergeInterrupted
+		}
+		return nil
+	}
+	err = merged(func(key string, info recordInfo) error {
+		pending = append(pending, relocation{key: key, info: info})
+		if len(pending) < relocateChunk {
+			return nil
+		}
+		return relocateNext()
+	})
+	if err == nil {
+		err = relocateNext()
+	}
 	if err != nil {
-		db.recover()
-		return
+		// Some keys may still point at the old segments, which then stay
+		// until the next merge moves them.
+		return err
 	}
 
-	newSeg := &segment{
-		id:       db.nextSegID,
-		file:     newSegFile,
-		filePath: newSegPath,
-		size:     offset,
-		index:    make(map[string]int64),
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+	if db.interrupted("manifest") {
+		return errMergeInterrupted
 	}
-
-	for k, loc := range newIndex {
-		newSeg.index[k] = loc.offset
+	segments := append([]*segment{newSeg}, db.segments[len(sealed)+1:]...)
+	if err := writeManifest(db.fs, db.dir, segments); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
-	db.segments = []*segment{newSeg}
-	db.out = newSeg
-	db.nextSegID++
-	db.index = newIndex
+	for key, from := range dropped {
+		if loc, ok := db.index.Get(key); ok && loc == from {
+			db.index.Delete(key)
+			db.cache.remove(key)
+		}
+	}
+	db.segments = segments
+	db.mergeCount++
+	db.lastMerge = db.now()
+	db.lastMergeDuration = time.Since(started)
 	db.mu.Unlock()
 
-	for _, seg := range db.segments[:len(db.segments)-1] {
-		os.Remove(seg.filePath)
+	for _, seg := range sealed {
+		seg.release()
+	}
+	return nil
+}
+
+func (db *Db) interrupted(step string) bool {
+	return db.interrupt != nil && db.interrupt(step)
+}
+
+// readSegmentRecords calls fn with every record of a segment, its offset
+// and its size.
+func readSegmentRecords(seg *segment, fn func(offset, size int64, record entry) error) error {
+	file, err := openFile(seg.fs, seg.filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	_, headerSize, err := readSegmentHeader(reader)
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", seg.filePath, err)
+	}
+
+	offset := int64(headerSize)
+	for {
+		var record entry
+		n, err := record.decodeFromReader(reader, seg.format)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("segment %s at offset %d: %w", seg.filePath, offset, err)
+		}
+		if err := fn(offset, int64(n), record); err != nil {
+			return err
+		}
+		offset += int64(n)
 	}
 }
 
@@ -1,9 +1,14 @@
 package datastore
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDb(t *testing.T) {
@@ -126,8 +131,8 @@ func TestMergeSegments(t *testing.T) {
 
 	db.mergeSegments()
 
-	if len(db.segments) != 1 {
-		t.Errorf("Expected 1 segment after merge, got %d", len(db.segments))
+	if len(db.segments) != 2 {
+		t.Errorf("Expected the merged and the active segment after merge, got %d", len(db.segments))
 	}
 }
 
@@ -228,6 +233,7 @@ func TestSegmentFileNaming(t *testing.T) {
 		"current-data": true,
 		"segment-1":    true,
 		"segment-2":    true,
+		"MANIFEST":     true,
 	}
 
 	for _, file := range files {
@@ -236,3 +242,445 @@ func TestSegmentFileNaming(t *testing.T) {
 		}
 	}
 }
+
+func TestDelete(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("k1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+	if err := db.Delete("k1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting missing key, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("k1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after reopen, got %v", err)
+	}
+	value, err := db.Get("k2")
+	if err != nil || value != "v2" {
+		t.Errorf("Expected 'v2' after reopen, got %q (%v)", value, err)
+	}
+
+	if err := db.Put("k1", "v1.1"); err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("k1")
+	if err != nil || value != "v1.1" {
+		t.Errorf("Expected 'v1.1' after re-put, got %q (%v)", value, err)
+	}
+}
+
+func TestDeleteDroppedByMerge(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := OpenWithMaxSize(tmp, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("filler", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.mergeSegments()
+
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after merge, got %v", err)
+	}
+	value, err := db.Get("kept")
+	if err != nil || value != "value" {
+		t.Errorf("Expected 'value' after merge, got %q (%v)", value, err)
+	}
+
+	keptSize := int64(segmentHeaderSize + len((&entry{key: "kept", value: "value"}).Encode()))
+	if size := db.segments[0].size; size != keptSize {
+		t.Errorf("Expected merged size %d, got %d", keptSize, size)
+	}
+}
+
+func TestOpenLegacySegment(t *testing.T) {
+	tmp := t.TempDir()
+
+	var data []byte
+	data = append(data, legacyRecord("k1", "v1", false)...)
+	data = append(data, legacyRecord("k2", "v2", false)...)
+	data = append(data, legacyRecord("k2", "", true)...)
+	if err := os.WriteFile(filepath.Join(tmp, outFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	value, err := db.Get("k1")
+	if err != nil || value != "v1" {
+		t.Errorf("Expected 'v1' from legacy segment, got %q (%v)", value, err)
+	}
+	if _, err := db.Get("k2"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for key deleted in legacy segment, got %v", err)
+	}
+
+	if err := db.Put("k3", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	if db.out.id == 0 || db.out.format != currentFormat {
+		t.Errorf("Expected writes to go to a new segment in the current format")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"k1": "v1", "k3": "v3"} {
+		value, err := db.Get(key)
+		if err != nil || value != expected {
+			t.Errorf("Get(%q) = %q (%v), wanted %q", key, value, err, expected)
+		}
+	}
+}
+
+func TestGetCorruptedRecord(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("key"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	pairs := [][]string{
+		{"k1", "v1"},
+		{"k2", "value2"},
+		{"k1", "v1.1"},
+		{"k3", "v3"},
+	}
+
+	var data []byte
+	data = append(data, encodeSegmentHeader(currentFormat)...)
+	ends := make([]int, len(pairs))
+	for i, pair := range pairs {
+		e := entry{key: pair[0], value: pair[1]}
+		data = append(data, e.Encode()...)
+		ends[i] = len(data)
+	}
+
+	for cut := 0; cut <= len(data); cut++ {
+		tmp := t.TempDir()
+		if err := os.WriteFile(filepath.Join(tmp, outFileName), data[:cut], 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := Open(tmp)
+		if err != nil {
+			t.Fatalf("Open() with file cut at %d failed: %s", cut, err)
+		}
+
+		expected := make(map[string]string)
+		validSize := int64(segmentHeaderSize)
+		for i, pair := range pairs {
+			if ends[i] <= cut {
+				expected[pair[0]] = pair[1]
+				validSize = int64(ends[i])
+			}
+		}
+
+		size, err := db.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != validSize {
+			t.Errorf("Cut at %d: expected size %d after recovery, got %d", cut, validSize, size)
+		}
+
+		for _, key := range []string{"k1", "k2", "k3"} {
+			value, err := db.Get(key)
+			if want, ok := expected[key]; ok {
+				if err != nil || value != want {
+					t.Errorf("Cut at %d: Get(%q) = %q (%v), wanted %q", cut, key, value, err, want)
+				}
+			} else if err != ErrNotFound {
+				t.Errorf("Cut at %d: Get(%q) expected ErrNotFound, got %q (%v)", cut, key, value, err)
+			}
+		}
+
+		if err := db.Put("after", "crash"); err != nil {
+			t.Fatalf("Cut at %d: Put after recovery failed: %s", cut, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatalf("Cut at %d: reopen failed: %s", cut, err)
+		}
+		if value, err := db.Get("after"); err != nil || value != "crash" {
+			t.Errorf("Cut at %d: lost write made after recovery: %q (%v)", cut, value, err)
+		}
+		db.Close()
+	}
+}
+
+func TestRecoverCorruptedTail(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("k1"); err != nil || value != "v1" {
+		t.Errorf("Expected 'v1', got %q (%v)", value, err)
+	}
+	if _, err := db.Get("k2"); err != ErrNotFound {
+		t.Errorf("Expected corrupted tail record to be dropped, got %v", err)
+	}
+}
+
+func TestRecoverCorruptedMiddle(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[segmentHeaderSize+v1HeaderSize] ^= 0xFF
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted opening segment corrupted in the middle, got %v", err)
+	}
+}
+
+func TestApplyWrites(t *testing.T) {
+	db, err := OpenWithMaxSize(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	reqs := []writeRequest{
+		{key: "a", value: "1"},
+		{key: "a", tombstone: true},
+		{key: "a", tombstone: true},
+		{key: "b", value: "2"},
+		{key: "c", tombstone: true},
+	}
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, writeRequest{key: fmt.Sprintf("key%d", i), value: fmt.Sprintf("value%d", i)})
+	}
+
+	// Keep the background merge out until the batch has been checked.
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+	errs := db.applyWrites(reqs)
+
+	expectedErrs := []error{nil, nil, ErrNotFound, nil, ErrNotFound}
+	for i, err := range errs {
+		var expected error
+		if i < len(expectedErrs) {
+			expected = expectedErrs[i]
+		}
+		if err != expected {
+			t.Errorf("Request %d: expected error %v, got %v", i, expected, err)
+		}
+	}
+
+	if _, err := db.Get("a"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for 'a', got %v", err)
+	}
+	if value, err := db.Get("b"); err != nil || value != "2" {
+		t.Errorf("Expected '2' for 'b', got %q (%v)", value, err)
+	}
+	for i := 0; i < 10; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i))
+		if err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(key%d) = %q (%v)", i, value, err)
+		}
+	}
+
+	if len(db.segments) < 2 {
+		t.Errorf("Expected the batch to roll over to new segments, got %d", len(db.segments))
+	}
+	for _, seg := range db.segments {
+		if seg.size > 100 {
+			t.Errorf("Segment %s grew to %d bytes, over the maximum", seg.filePath, seg.size)
+		}
+	}
+}
+
+func benchmarkPut(b *testing.B, maxBatch int, opts ...Option) {
+	db, err := Open(b.TempDir(), opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.maxBatch = maxBatch
+
+	var counter int64
+	var mu sync.Mutex
+	value := strings.Repeat("v", 100)
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			counter++
+			key := fmt.Sprintf("key%d", counter%1000)
+			mu.Unlock()
+			if err := db.Put(key, value); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPut(b *testing.B) {
+	for _, policy := range []string{"never", "batch"} {
+		p, _ := ParseSyncPolicy(policy)
+		b.Run(policy+"/one-at-a-time", func(b *testing.B) {
+			benchmarkPut(b, 1, WithSyncPolicy(p))
+		})
+		b.Run(policy+"/grouped", func(b *testing.B) {
+			benchmarkPut(b, maxWriteBatch, WithSyncPolicy(p))
+		})
+	}
+}
+
+func TestCloseDuringWrites(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("value", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the write lock as the writer does while it applies an Increment
+	// or CompareAndSwap, which reads the current record through the workers.
+	db.writeMutex.Lock()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	<-db.writerDone
+	time.Sleep(10 * time.Millisecond)
+
+	record, err := db.getEntry("value")
+	db.writeMutex.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to read a record while closing: %v", err)
+	}
+	if record.value != "v" {
+		t.Errorf("Expected v, got %q", record.value)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("value", "w"); err != errClosed {
+		t.Errorf("Expected errClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	indexDirPrefix = "index-"
+	// defaultIndexBuffer is how many changes a disk index keeps in memory
+	// before writing them out as a sorted run.
+	defaultIndexBuffer = 1 << 16
+	// indexBlockSize is how many entries of a run share a key kept in
+	// memory to find them by.
+	indexBlockSize  = 128
+	indexFilterRate = 0.01
+)
+
+// diskIndex keeps the latest changes in memory and everything else in
+// sorted runs on disk. Of a run, only every indexBlockSize-th key and a
+// Bloom filter stay in memory, so that a lookup reads at most one block of
+// each run, and usually of a single one. Runs of similar size are merged,
+// which keeps about log2(keys/buffer) of them.
+//
+// The runs are scratch files: the index is rebuilt from the segments
+// whenever the Db is opened.
+type diskIndex struct {
+	fs      FS
+	dir     string
+	mem     map[string]indexEntry
+	maxMem  int
+	runs    []*indexRun // oldest first
+	nextRun int
+	len     int
+
+	errMu sync.Mutex
+	err   error
+}
+
+type indexEntry struct {
+	key     string
+	loc     segmentLocation
+	deleted bool
+}
+
+type indexRun struct {
+	file   File
+	path   string
+	count  int
+	size   int64
+	blocks []indexBlock
+	filter *bloomFilter
+}
+
+type indexBlock struct {
+	key    string
+	offset int64
+}
+
+func newDiskIndex(fsys FS, parent string, maxMem int) (*diskIndex, error) {
+	dir := filepath.Join(parent, indexDirPrefix+newEpoch())
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskIndex{
+		fs:     fsys,
+		dir:    dir,
+		mem:    make(map[string]indexEntry),
+		maxMem: max(maxMem, 1),
+	}, nil
+}
+
+func (ix *diskIndex) Get(key string) (segmentLocation, bool) {
+	e, ok := ix.find(key)
+	if !ok || e.deleted {
+		return segmentLocation{}, false
+	}
+	return e.loc, true
+}
+
+// find returns the latest entry of key, looking in memory first and then
+// in the runs from the newest one.
+func (ix *diskIndex) find(key string) (indexEntry, bool) {
+	if e, ok := ix.mem[key]; ok {
+		return e, true
+	}
+	if len(ix.runs) == 0 {
+		return indexEntry{}, false
+	}
+	h1, h2 := bloomHash(key)
+	for i := len(ix.runs) - 1; i >= 0; i-- {
+		e, ok, err := ix.runs[i].find(key, h1, h2)
+		if err != nil {
+			ix.fail(err)
+			return indexEntry{}, false
+		}
+		if ok {
+			return e, true
+		}
+	}
+	return indexEntry{}, false
+}
+
+func (ix *diskIndex) Set(key string, loc segmentLocation) (segmentLocation, bool) {
+	prev, ok := ix.Get(key)
+	ix.mem[key] = indexEntry{key: key, loc: loc}
+	if !ok {
+		ix.len++
+	}
+	ix.maybeFlush()
+	return prev, ok
+}
+
+func (ix *diskIndex) Delete(key string) (segmentLocation, bool) {
+	prev, ok := ix.Get(key)
+	if !ok {
+		return prev, false
+	}
+	// A deletion has to be recorded only while a run may hold the key.
+	if len(ix.runs) == 0 {
+		delete(ix.mem, key)
+	} else {
+		ix.mem[key] = indexEntry{key: key, deleted: true}
+	}
+	ix.len--
+	ix.maybeFlush()
+	return prev, true
+}
+
+func (ix *diskIndex) Len() int {
+	return ix.len
+}
+
+func (ix *diskIndex) Ascend(start, end string, fn func(key string, loc segmentLocation) bool) {
+	var pending []indexEntry
+	for key, e := range ix.mem {
+		if key >= start && (end == "" || key < end) {
+			pending = append(pending, e)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].key < pending[j].key })
+
+	// The cursors go from the newest changes to the oldest, so the first
+	// one at a key has its latest entry.
+	cursors := []*indexCursor{{pending: pending}}
+	cursors[0].next()
+	for i := len(ix.runs) - 1; i >= 0; i-- {
+		cursors = append(cursors, ix.runs[i].cursor(start))
+	}
+	defer func() {
+		for _, c := range cursors {
+			if c.err != nil {
+				ix.fail(c.err)
+			}
+		}
+	}()
+
+	for {
+		var first *indexCursor
+		for _, c := range cursors {
+			if c.ok && (first == nil || c.entry.key < first.entry.key) {
+				first = c
+			}
+		}
+		if first == nil {
+			return
+		}
+		e := first.entry
+		for _, c := range cursors {
+			if c.ok && c.entry.key == e.key {
+				c.next()
+			}
+		}
+		if end != "" && e.key >= end {
+			return
+		}
+		if !e.deleted && !fn(e.key, e.loc) {
+			return
+		}
+	}
+}
+
+func (ix *diskIndex) Err() error {
+	ix.errMu.Lock()
+	defer ix.errMu.Unlock()
+	return ix.err
+}
+
+func (ix *diskIndex) fail(err error) {
+	ix.errMu.Lock()
+	defer ix.errMu.Unlock()
+	if ix.err == nil {
+		ix.err = fmt.Errorf("disk index: %w", err)
+	}
+}
+
+func (ix *diskIndex) Close() error {
+	for _, run := range ix.runs {
+		run.file.Close()
+	}
+	ix.runs = nil
+	return ix.fs.RemoveAll(ix.dir)
+}
+
+// maybeFlush writes the changes in memory out as a run once there are
+// maxMem of them, and merges the newest runs while they are of similar
+// size.
+func (ix *diskIndex) maybeFlush() {
+	if len(ix.mem) < ix.maxMem {
+		return
+	}
+	entries := make([]indexEntry, 0, len(ix.mem))
+	for _, e := range ix.mem {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	run, err := ix.writeRun(len(entries), func(add func(indexEntry) error) error {
+		for _, e := range entries {
+			if err := add(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ix.fail(err)
+		return
+	}
+	ix.mem = make(map[string]indexEntry)
+	ix.runs = append(ix.runs, run)
+
+	for n := len(ix.runs); n >= 2 && ix.runs[n-2].count <= 2*ix.runs[n-1].count; n = len(ix.runs) {
+		if err := ix.mergeRuns(); err != nil {
+			ix.fail(err)
+			return
+		}
+	}
+}
+
+// mergeRuns replaces the two newest runs with a single one.
+func (ix *diskIndex) mergeRuns() error {
+	n := len(ix.runs)
+	older, newer := ix.runs[n-2], ix.runs[n-1]
+	// Deletions are dropped once no older run is left to hold the key.
+	keepDeleted := n > 2
+
+	run, err := ix.writeRun(older.count+newer.count, func(add func(indexEntry) error) error {
+		a, b := older.cursor(""), newer.cursor("")
+		for a.ok || b.ok {
+			var e indexEntry
+			switch {
+			case !b.ok || (a.ok && a.entry.key < b.entry.key):
+				e = a.entry
+				a.next()
+			case !a.ok || b.entry.key < a.entry.key:
+				e = b.entry
+				b.next()
+			default:
+				e = b.entry
+				a.next()
+				b.next()
+			}
+			if e.deleted && !keepDeleted {
+				continue
+			}
+			if err := add(e); err != nil {
+				return err
+			}
+		}
+		if a.err != nil {
+			return a.err
+		}
+		return b.err
+	})
+	if err != nil {
+		return err
+	}
+	older.remove(ix.fs)
+	newer.remove(ix.fs)
+	ix.runs = append(ix.runs[:n-2], run)
+	return nil
+}
+
+// writeRun writes the entries each adds, which come sorted by key, to a
+// new run sized for up to count of them.
+func (ix *diskIndex) writeRun(count int, each func(add func(indexEntry) error) error) (*indexRun, error) {
+	path := filepath.Join(ix.dir, fmt.Sprintf("run-%d", ix.nextRun))
+	ix.nextRun++
+	f, err := ix.fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &indexRun{file: f, path: path, filter: newBloomFilter(int64(count), indexFilterRate)}
+	w := bufio.NewWriter(f)
+	var buf []byte
+	err = each(func(e indexEntry) error {
+		if run.count%indexBlockSize == 0 {
+			run.blocks = append(run.blocks, indexBlock{key: e.key, offset: run.size})
+		}
+		run.filter.add(bloomHash(e.key))
+		buf = appendIndexEntry(buf[:0], e)
+		n, err := w.Write(buf)
+		run.size += int64(n)
+		run.count++
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		run.remove(ix.fs)
+		return nil, err
+	}
+	return run, nil
+}
+
+func (run *indexRun) remove(fsys FS) {
+	run.file.Close()
+	fsys.Remove(run.path)
+}
+
+func (run *indexRun) find(key string, h1, h2 uint64) (indexEntry, bool, error) {
+	if !run.filter.mayContain(h1, h2) {
+		return indexEntry{}, false, nil
+	}
+	i := sort.Search(len(run.blocks), func(i int) bool { return run.blocks[i].key > key }) - 1
+	if i < 0 {
+		return indexEntry{}, false, nil
+	}
+	end := run.size
+	if i+1 < len(run.blocks) {
+		end = run.blocks[i+1].offset
+	}
+	block := make([]byte, end-run.blocks[i].offset)
+	if n, err := run.file.ReadAt(block, run.blocks[i].offset); n < len(block) {
+		return indexEntry{}, false, err
+	}
+
+	for len(block) > 0 {
+		e, n, err := decodeIndexEntry(block)
+		if err != nil {
+			return indexEntry{}, false, err
+		}
+		if e.key >= key {
+			return e, e.key == key, nil
+		}
+		block = block[n:]
+	}
+	return indexEntry{}, false, nil
+}
+
+// cursor returns a cursor at the first entry of the run not less than start.
+func (run *indexRun) cursor(start string) *indexCursor {
+	i := max(sort.Search(len(run.blocks), func(i int) bool { return run.blocks[i].key > start })-1, 0)
+	var offset int64
+	if i < len(run.blocks) {
+		offset = run.blocks[i].offset
+	}
+	c := &indexCursor{r: bufio.NewReader(io.NewSectionReader(run.file, offset, run.size-offset))}
+	for c.next(); c.ok && c.entry.key < start; c.next() {
+	}
+	return c
+}
+
+// indexCursor walks the entries of a run, or the pending ones, in order.
+type indexCursor struct {
+	r       *bufio.Reader
+	pending []indexEntry
+	entry   indexEntry
+	ok      bool
+	err     error
+}
+
+func (c *indexCursor) next() {
+	if c.r == nil {
+		c.ok = len(c.pending) > 0
+		if c.ok {
+			c.entry, c.pending = c.pending[0], c.pending[1:]
+		}
+		return
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		c.ok = false
+		if err != io.EOF {
+			c.err = err
+		}
+		return
+	}
+	data := make([]byte, 4+int(binary.LittleEndian.Uint32(head[:]))+indexEntryFixedSize)
+	copy(data, head[:])
+	if _, err := io.ReadFull(c.r, data[4:]); err != nil {
+		c.ok, c.err = false, err
+		return
+	}
+	c.entry, _, c.err = decodeIndexEntry(data)
+	c.ok = c.err == nil
+}
+
+// Run entry layout:
+// (kl) (key) (flags) (segID) (offset) (size) (expiresAt)
+// 4    kl    1       8       8        8      8
+const indexEntryFixedSize = 33
+
+func appendIndexEntry(buf []byte, e indexEntry) []byte {
+	var flags byte
+	if e.deleted {
+		flags |= flagTombstone
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(e.key)))
+	buf = append(buf, e.key...)
+	buf = append(buf, flags)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(e.loc.segID))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(e.loc.offset))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(e.loc.size))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(e.loc.expiresAt))
+	return buf
+}
+
+func decodeIndexEntry(data []byte) (indexEntry, int, error) {
+	if len(data) < 4 {
+		return indexEntry{}, 0, fmt.Errorf("%w: truncated index entry", ErrCorrupted)
+	}
+	kl := int(binary.LittleEndian.Uint32(data))
+	n := 4 + kl + indexEntryFixedSize
+	if len(data) < n {
+		return indexEntry{}, 0, fmt.Errorf("%w: truncated index entry", ErrCorrupted)
+	}
+	rest := data[4+kl:]
+	return indexEntry{
+		key:     string(data[4 : 4+kl]),
+		deleted: rest[0]&flagTombstone != 0,
+		loc: segmentLocation{
+			segID:     int(binary.LittleEndian.Uint64(rest[1:])),
+			offset:    int64(binary.LittleEndian.Uint64(rest[9:])),
+			size:      int64(binary.LittleEndian.Uint64(rest[17:])),
+			expiresAt: int64(binary.LittleEndian.Uint64(rest[25:])),
+		},
+	}, n, nil
+}
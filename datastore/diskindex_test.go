@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func withIndexBuffer(n int) Option {
+	return func(o *options) {
+		o.indexBuffer = n
+	}
+}
+
+func TestDiskIndex(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithIndex(IndexDisk), withIndexBuffer(32), WithMaxSize(1000), WithCompactionPolicy(CompactionPolicy{})}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%03d", i%300)
+		if i%7 == 0 {
+			if err := db.Delete(key); err != nil && err != ErrNotFound {
+				t.Fatal(err)
+			}
+			delete(expected, key)
+			continue
+		}
+		value := fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	check := func(db *Db) {
+		t.Helper()
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			value, err := db.Get(key)
+			if want, ok := expected[key]; !ok && err != ErrNotFound {
+				t.Errorf("Get(%q) expected ErrNotFound, got %q (%v)", key, value, err)
+			} else if ok && (err != nil || value != want) {
+				t.Errorf("Get(%q) = %q (%v), wanted %q", key, value, err, want)
+			}
+		}
+		if s := db.Stats(); s.LiveKeys != len(expected) {
+			t.Errorf("Expected %d live keys, got %d", len(expected), s.LiveKeys)
+		}
+		n := 0
+		it := db.ScanPrefix("key")
+		for it.Next() {
+			n++
+		}
+		if err := it.Close(); err != nil || n != len(expected) {
+			t.Errorf("Scan returned %d keys (%v), wanted %d", n, err, len(expected))
+		}
+	}
+	check(db)
+
+	// Only the active segment keeps its keys in memory.
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		if seg.index != nil {
+			t.Errorf("Sealed segment %s kept its index", seg.filePath)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+	checkFiles(t, dir)
+}
@@ -2,57 +2,298 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"time"
 )
 
+var ErrCorrupted = fmt.Errorf("record is corrupted")
+
+const (
+	formatLegacy  byte = 0
+	formatV1      byte = 1
+	currentFormat      = formatV1
+)
+
+// Every segment written in a versioned format starts with a header:
+// four zero bytes (a legacy record never has zero size), "KVS" and
+// the format version. Segments without the header use the legacy format.
+const segmentHeaderSize = 8
+
+var segmentMagic = []byte{0, 0, 0, 0, 'K', 'V', 'S'}
+
+func encodeSegmentHeader(format byte) []byte {
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	header[segmentHeaderSize-1] = format
+	return header
+}
+
+var errTornHeader = fmt.Errorf("segment header is incomplete")
+
+func readSegmentHeader(in *bufio.Reader) (byte, int, error) {
+	header, err := in.Peek(segmentHeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, 0, err
+	}
+	if len(header) > 0 && len(header) < segmentHeaderSize && bytes.HasPrefix(segmentMagic, header[:min(len(header), len(segmentMagic))]) {
+		return 0, 0, errTornHeader
+	}
+	if len(header) < segmentHeaderSize || !bytes.HasPrefix(header, segmentMagic) {
+		return formatLegacy, 0, nil
+	}
+	format := header[segmentHeaderSize-1]
+	if format != formatV1 {
+		return 0, 0, fmt.Errorf("unsupported segment format %d", format)
+	}
+	_, err = in.Discard(segmentHeaderSize)
+	return format, segmentHeaderSize, err
+}
+
+const maxRecordSize = 1 << 28
+
+const (
+	flagTombstone byte = 1 << iota
+	// flagContinued marks a record of a batch that is followed by more
+	// records of the same batch. The last record of a batch has it unset.
+	flagContinued
+	flagExpires
+	// flagInt64 marks a value holding a little-endian int64.
+	flagInt64
+	// flagCompressed marks a string value stored compressed with flate.
+	flagCompressed
+)
+
+type ValueType byte
+
+const (
+	TypeString ValueType = iota
+	TypeInt64
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt64:
+		return "int64"
+	}
+	return fmt.Sprintf("ValueType(%d)", byte(t))
+}
+
 type entry struct {
 	key, value string
+	valueType  ValueType
+	tombstone  bool
+	continued  bool
+	// compressed is set while value holds the compressed form.
+	compressed bool
+	// expiresAt is the expiry time in Unix nanoseconds, 0 if the record
+	// does not expire.
+	expiresAt int64
 }
 
-// 0           4    8     kl+8  kl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)
-// 4           4    ....  4     .....     <-- length
+const int64Size = 8
+
+func int64Entry(key string, n int64) entry {
+	return entry{key: key, value: string(binary.LittleEndian.AppendUint64(nil, uint64(n))), valueType: TypeInt64}
+}
+
+func (e *entry) int64() int64 {
+	return int64(binary.LittleEndian.Uint64([]byte(e.value)))
+}
+
+// Format v1:
+// 0           4      8       9           ?    ?+4   ?+kl+4 ?+kl+8   <-- offset
+// (full size) (crc)  (flags) [expiresAt] (kl) (key) (vl)   (value)
+// 4           4      1       8           4    ....  4      .....    <-- length
+//
+// crc is CRC32 (IEEE) of the full size followed by everything after crc.
+// expiresAt is only present if flagExpires is set. With flagInt64 the
+// value is always 8 bytes long. With flagCompressed the value is a flate
+// stream of the actual value.
+const (
+	v1HeaderSize = 17
+	expiresSize  = 8
+)
 
 func (e *entry) Encode() []byte {
 	kl, vl := len(e.key), len(e.value)
-	size := kl + vl + 12
+	var flags byte
+	if e.tombstone {
+		flags |= flagTombstone
+		vl = 0
+	}
+	if e.continued {
+		flags |= flagContinued
+	}
+	if e.valueType == TypeInt64 && !e.tombstone {
+		flags |= flagInt64
+	}
+	if e.compressed && !e.tombstone {
+		flags |= flagCompressed
+	}
+	size := e.encodedSize()
+	if e.expiresAt != 0 {
+		flags |= flagExpires
+	}
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	res[8] = flags
+	pos := 9
+	if e.expiresAt != 0 {
+		binary.LittleEndian.PutUint64(res[pos:], uint64(e.expiresAt))
+		pos += expiresSize
+	}
+	binary.LittleEndian.PutUint32(res[pos:], uint32(kl))
+	copy(res[pos+4:], e.key)
+	binary.LittleEndian.PutUint32(res[pos+kl+4:], uint32(vl))
+	copy(res[pos+kl+8:], e.value[:vl])
+	binary.LittleEndian.PutUint32(res[4:], checksum(res))
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	e.key = decodeString(input[4:])
-	e.value = decodeString(input[len(e.key)+8:])
+// encodedSize returns the length of what Encode returns for e.
+func (e *entry) encodedSize() int {
+	size := len(e.key) + v1HeaderSize
+	if !e.tombstone {
+		size += len(e.value)
+	}
+	if e.expiresAt != 0 {
+		size += expiresSize
+	}
+	return size
+}
+
+func checksum(record []byte) uint32 {
+	crc := crc32.ChecksumIEEE(record[:4])
+	return crc32.Update(crc, crc32.IEEETable, record[8:])
+}
+
+func (e *entry) Decode(input []byte) error {
+	if len(input) < v1HeaderSize || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return fmt.Errorf("%w: bad record size", ErrCorrupted)
+	}
+	if binary.LittleEndian.Uint32(input[4:]) != checksum(input) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	flags := input[8]
+	headerSize, pos := v1HeaderSize, 9
+	e.expiresAt = 0
+	if flags&flagExpires != 0 {
+		headerSize += expiresSize
+		if len(input) < headerSize {
+			return fmt.Errorf("%w: bad record size", ErrCorrupted)
+		}
+		e.expiresAt = int64(binary.LittleEndian.Uint64(input[pos:]))
+		pos += expiresSize
+	}
+	kl := int(binary.LittleEndian.Uint32(input[pos:]))
+	if kl > len(input)-headerSize {
+		return fmt.Errorf("%w: bad key length", ErrCorrupted)
+	}
+	vl := int(binary.LittleEndian.Uint32(input[pos+kl+4:]))
+	if kl+vl+headerSize != len(input) {
+		return fmt.Errorf("%w: bad value length", ErrCorrupted)
+	}
+	e.valueType = TypeString
+	if flags&flagInt64 != 0 {
+		if vl != int64Size {
+			return fmt.Errorf("%w: bad int64 length", ErrCorrupted)
+		}
+		e.valueType = TypeInt64
+	}
+	e.compressed = flags&flagCompressed != 0
+	if e.compressed && e.valueType != TypeString {
+		return fmt.Errorf("%w: compressed int64", ErrCorrupted)
+	}
+	e.tombstone = flags&flagTombstone != 0
+	e.continued = flags&flagContinued != 0
+	e.key = string(input[pos+4 : pos+4+kl])
+	e.value = string(input[pos+kl+8:])
+	return nil
 }
 
-func decodeString(v []byte) string {
-	l := binary.LittleEndian.Uint32(v)
-	buf := make([]byte, l)
-	copy(buf, v[4:4+int(l)])
-	return string(buf)
+func (e *entry) expired(now time.Time) bool {
+	return e.expiresAt != 0 && now.UnixNano() >= e.expiresAt
+}
+
+// Legacy format:
+// 0           4    8     kl+8  kl+12     <-- offset
+// (full size) (kl) (key) (vl)  (value)
+// 4           4    ....  4     .....     <-- length
+//
+// A tombstone has no value and stores legacyTombstoneLen in place of vl.
+const (
+	legacyHeaderSize   = 12
+	legacyTombstoneLen = 0xFFFFFFFF
+)
+
+func (e *entry) decodeLegacy(input []byte) error {
+	if len(input) < legacyHeaderSize {
+		return fmt.Errorf("%w: bad record size", ErrCorrupted)
+	}
+	kl := int(binary.LittleEndian.Uint32(input[4:]))
+	if kl > len(input)-legacyHeaderSize {
+		return fmt.Errorf("%w: bad key length", ErrCorrupted)
+	}
+	e.key = string(input[8 : 8+kl])
+	vl := binary.LittleEndian.Uint32(input[kl+8:])
+	e.tombstone = vl == legacyTombstoneLen
+	e.continued = false
+	e.compressed = false
+	e.expiresAt = 0
+	e.valueType = TypeString
+	if e.tombstone {
+		e.value = ""
+		return nil
+	}
+	if kl+int(vl)+legacyHeaderSize != len(input) {
+		return fmt.Errorf("%w: bad value length", ErrCorrupted)
+	}
+	e.value = string(input[kl+12:])
+	return nil
 }
 
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	return e.decodeFromReader(in, currentFormat)
+}
+
+func (e *entry) decodeFromReader(in *bufio.Reader, format byte) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
-			return 0, err
+			if len(sizeBuf) == 0 {
+				return 0, io.EOF
+			}
+			err = io.ErrUnexpectedEOF
 		}
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
-	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	size := int(binary.LittleEndian.Uint32(sizeBuf))
+	minSize := v1HeaderSize
+	if format == formatLegacy {
+		minSize = legacyHeaderSize
+	}
+	if size < minSize || size > maxRecordSize {
+		return 0, fmt.Errorf("DecodeFromReader: %w: bad record size %d", ErrCorrupted, size)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
-	e.Decode(buf)
+	if format == formatLegacy {
+		err = e.decodeLegacy(buf)
+	} else {
+		err = e.Decode(buf)
+	}
+	if err != nil {
+		return n, fmt.Errorf("DecodeFromReader: %w", err)
+	}
 	return n, nil
 }
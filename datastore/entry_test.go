@@ -3,11 +3,14 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -21,7 +24,7 @@ func TestReadValue(t *testing.T) {
 	var (
 		a, b entry
 	)
-	a = entry{"key", "test-value"}
+	a = entry{key: "key", value: "test-value"}
 	originalBytes := a.Encode()
 
 	b.Decode(originalBytes)
@@ -43,3 +46,122 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(originalBytes))
 	}
 }
+
+func TestTombstone(t *testing.T) {
+	a := entry{key: "key", tombstone: true}
+	data := a.Encode()
+
+	var b entry
+	n, err := b.DecodeFromReader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(data))
+	}
+	if a != b {
+		t.Errorf("Tombstone mismatch: %v != %v", a, b)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	a := entry{key: "key", value: "test-value"}
+	data := a.Encode()
+
+	for i := range data {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0x40
+
+		var b entry
+		if err := b.Decode(corrupted); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Decode() with byte %d flipped: expected ErrCorrupted, got %v", i, err)
+		}
+	}
+
+	data[len(data)-1] ^= 1
+	var b entry
+	_, err := b.DecodeFromReader(bufio.NewReader(bytes.NewReader(data)))
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("DecodeFromReader() expected ErrCorrupted, got %v", err)
+	}
+}
+
+func legacyRecord(key, value string, tombstone bool) []byte {
+	kl, vl := len(key), len(value)
+	size := kl + vl + 12
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	copy(res[8:], key)
+	if tombstone {
+		binary.LittleEndian.PutUint32(res[kl+8:], legacyTombstoneLen)
+		return res[:kl+12]
+	}
+	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	copy(res[kl+12:], value)
+	return res
+}
+
+func TestLegacyFormat(t *testing.T) {
+	var data []byte
+	data = append(data, legacyRecord("key", "legacy-value", false)...)
+	data = append(data, legacyRecord("key", "", true)...)
+
+	in := bufio.NewReader(bytes.NewReader(data))
+	format, headerSize, err := readSegmentHeader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != formatLegacy || headerSize != 0 {
+		t.Fatalf("Expected legacy format without header, got format %d header %d", format, headerSize)
+	}
+
+	var a, b entry
+	if _, err := a.decodeFromReader(in, format); err != nil {
+		t.Fatal(err)
+	}
+	if a.key != "key" || a.value != "legacy-value" || a.tombstone {
+		t.Errorf("Unexpected legacy record %v", a)
+	}
+	if _, err := b.decodeFromReader(in, format); err != nil {
+		t.Fatal(err)
+	}
+	if b.key != "key" || !b.tombstone {
+		t.Errorf("Unexpected legacy tombstone %v", b)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	a := entry{key: "key", value: "value", expiresAt: 1234567890}
+	data := a.Encode()
+
+	var b entry
+	if err := b.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("Expiring record mismatch: %v != %v", a, b)
+	}
+	if len(data) != len((&entry{key: "key", value: "value"}).Encode())+expiresSize {
+		t.Errorf("Unexpected encoded size %d", len(data))
+	}
+}
+
+func TestInt64Entry(t *testing.T) {
+	for _, n := range []int64{0, 42, -1, math.MaxInt64, math.MinInt64} {
+		a := int64Entry("counter", n)
+		var b entry
+		if err := b.Decode(a.Encode()); err != nil {
+			t.Fatal(err)
+		}
+		if b.valueType != TypeInt64 || b.int64() != n {
+			t.Errorf("Expected int64 %d, got %v %d", n, b.valueType, b.int64())
+		}
+	}
+
+	bad := entry{key: "counter", value: "123", valueType: TypeInt64}
+	var b entry
+	if err := b.Decode(bad.Encode()); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted for a short int64, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"os"
+	"sync"
+)
+
+type FaultOp string
+
+const (
+	FaultWrite  FaultOp = "write"
+	FaultSync   FaultOp = "sync"
+	FaultRename FaultOp = "rename"
+)
+
+// FaultFS passes everything through to another FS, except the writes,
+// fsyncs and renames it is told to fail. A failed write still stores the
+// first half of the data, as a torn write would.
+type FaultFS struct {
+	FS
+
+	mu   sync.Mutex
+	fail func(op FaultOp, name string) error
+}
+
+func NewFaultFS(fsys FS) *FaultFS {
+	return &FaultFS{FS: fsys}
+}
+
+// FailOn makes every operation fail with the error fn returns for it. A
+// nil error lets the operation through, and FailOn(nil) stops failing.
+// For renames, name is the new name; for directory syncs, the directory.
+func (f *FaultFS) FailOn(fn func(op FaultOp, name string) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fn
+}
+
+func (f *FaultFS) check(op FaultOp, name string) error {
+	f.mu.Lock()
+	fn := f.fail
+	f.mu.Unlock()
+	if fn == nil {
+		return nil
+	}
+	return fn(op, name)
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	if err := f.check(FaultRename, newname); err != nil {
+		return err
+	}
+	return f.FS.Rename(oldname, newname)
+}
+
+func (f *FaultFS) SyncDir(name string) error {
+	if err := f.check(FaultSync, name); err != nil {
+		return err
+	}
+	return f.FS.SyncDir(name)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.check(FaultWrite, f.name); err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.check(FaultSync, f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errInjected = errors.New("injected fault")
+
+func fillDb(t *testing.T, db Store, n int) map[string]string {
+	t.Helper()
+	expected := make(map[string]string)
+	for i := 0; i < n; i++ {
+		key, value := fmt.Sprintf("key%d", i%7), fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	return expected
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	dir := filepath.Join(t.TempDir(), "db")
+
+	db, err := Open(dir, WithFS(fsys), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fillDb(t, db, 30)
+	if len(db.segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(db.segments))
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected)
+
+	snapDir := filepath.Join(filepath.Dir(dir), "snap")
+	if err := db.Snapshot(snapDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing on disk, got %v", err)
+	}
+
+	db, err = Open(dir, WithFS(fsys), WithMaxSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, expected)
+	checkFilesOn(t, fsys, dir)
+
+	restored, err := OpenFromSnapshot(snapDir, filepath.Join(filepath.Dir(dir), "restored"), WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	checkContents(t, restored, expected)
+}
+
+func TestFailedWrite(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	dir := "/db"
+
+	db, err := Open(dir, WithFS(fsys), WithMaxSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fillDb(t, db, 10)
+	size := db.out.size
+
+	fsys.FailOn(func(op FaultOp, name string) error {
+		if op == FaultWrite {
+			return errInjected
+		}
+		return nil
+	})
+	if err := db.Put("key0", "lost"); !errors.Is(err, errInjected) {
+		t.Fatalf("Expected the injected error, got %v", err)
+	}
+	if db.out.size != size {
+		t.Errorf("Expected the torn write to be discarded, segment grew from %d to %d", size, db.out.size)
+	}
+	checkContents(t, db, expected)
+
+	fsys.FailOn(nil)
+	if err := db.Put("key1", "after"); err != nil {
+		t.Fatal(err)
+	}
+	expected["key1"] = "after"
+
+	// The database is abandoned without Close, as in a crash.
+	db, err = Open(dir, WithFS(fsys), WithMaxSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, expected)
+}
+
+func TestFailedSync(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	db, err := Open("/db", WithFS(fsys), WithSyncPolicy(SyncBatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fsys.FailOn(func(op FaultOp, name string) error {
+		if op == FaultSync {
+			return errInjected
+		}
+		return nil
+	})
+	if err := db.Put("key", "value"); !errors.Is(err, errInjected) {
+		t.Errorf("Expected a failed fsync to fail the write, got %v", err)
+	}
+	fsys.FailOn(nil)
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedRename(t *testing.T) {
+	for _, target := range []string{segmentPrefix, manifestFileName} {
+		t.Run(target, func(t *testing.T) {
+			fsys := NewFaultFS(NewMemFS())
+			dir := "/db"
+
+			db, err := Open(dir, WithFS(fsys), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := fillDb(t, db, 30)
+
+			fsys.FailOn(func(op FaultOp, name string) error {
+				if op == FaultRename && strings.HasPrefix(filepath.Base(name), target) {
+					return errInjected
+				}
+				return nil
+			})
+			if err := db.Compact(); !errors.Is(err, errInjected) {
+				t.Fatalf("Expected the merge to fail, got %v", err)
+			}
+			fsys.FailOn(nil)
+			checkContents(t, db, expected)
+
+			db, err = Open(dir, WithFS(fsys), WithMaxSize(100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkContents(t, db, expected)
+			checkFilesOn(t, fsys, dir)
+
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			checkContents(t, db, expected)
+		})
+	}
+}
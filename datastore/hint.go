@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	hintSuffix  = ".hint"
+	hintVersion = 3
+)
+
+var hintMagic = []byte{'K', 'V', 'H', hintVersion}
+
+var errStaleHint = fmt.Errorf("hint is stale")
+
+type recordInfo struct {
+	offset    int64
+	size      int64
+	tombstone bool
+	expiresAt int64
+}
+
+type hintEntry struct {
+	key string
+	recordInfo
+}
+
+// Hint file layout:
+// (magic) (covered size) (records) entries... (crc)
+// 4       8              8                    4
+//
+// Each entry is (kl) (key) (offset) (size) (flags) (expiresAt), that is
+// 4+kl+8+4+1+8 bytes.
+// The hint describes the last record of every key within the first
+// covered size bytes of its segment, which hold records records in all.
+
+func hintPath(segPath string) string {
+	return segPath + hintSuffix
+}
+
+func writeHint(seg *segment) error {
+	return writeHintFrom(seg, func(fn func(key string, info recordInfo) error) error {
+		for key, info := range seg.index {
+			if err := fn(key, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeHintFrom writes the hint of seg with the records each passes on,
+// without holding them all in memory.
+func writeHintFrom(seg *segment, each func(fn func(key string, info recordInfo) error) error) error {
+	path := hintPath(seg.filePath)
+	tmpPath := path + ".tmp"
+	f, err := seg.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+
+	buf := append([]byte(nil), hintMagic...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(seg.size))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(seg.records))
+	_, err = w.Write(buf)
+	if err == nil {
+		err = each(func(key string, info recordInfo) error {
+			var flags byte
+			if info.tombstone {
+				flags |= flagTombstone
+			}
+			buf = binary.LittleEndian.AppendUint32(buf[:0], uint32(len(key)))
+			buf = append(buf, key...)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(info.offset))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(info.size))
+			buf = append(buf, flags)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(info.expiresAt))
+			_, err := w.Write(buf)
+			return err
+		})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		seg.fs.Remove(tmpPath)
+		return err
+	}
+	return seg.fs.Rename(tmpPath, path)
+}
+
+// readHint calls fn with every entry of the hint of seg and returns the
+// size and number of records it covers. The checksum is verified before
+// the first entry is passed on, so the entries are not held in memory.
+func readHint(seg *segment, fn func(h hintEntry)) (int64, int64, error) {
+	f, err := openFile(seg.fs, hintPath(seg.filePath))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+	if size < int64(len(hintMagic)+20) {
+		return 0, 0, fmt.Errorf("%w: unknown hint format", errStaleHint)
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(f, 0, size-4)); err != nil {
+		return 0, 0, err
+	}
+	var sum [4]byte
+	if _, err := f.ReadAt(sum[:], size-4); err != nil {
+		return 0, 0, err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(sum[:]) {
+		return 0, 0, fmt.Errorf("%w: %w", errStaleHint, ErrCorrupted)
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(f, 0, size-4))
+	header := make([]byte, len(hintMagic)+16)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(header[:len(hintMagic)], hintMagic) {
+		return 0, 0, fmt.Errorf("%w: unknown hint format", errStaleHint)
+	}
+	covered := int64(binary.LittleEndian.Uint64(header[len(hintMagic):]))
+	if covered > seg.size || (seg.format != formatLegacy && covered < segmentHeaderSize) {
+		return 0, 0, fmt.Errorf("%w: covers %d bytes of %d", errStaleHint, covered, seg.size)
+	}
+	records := int64(binary.LittleEndian.Uint64(header[len(hintMagic)+8:]))
+
+	for {
+		var kl [4]byte
+		if _, err := io.ReadFull(in, kl[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("%w: truncated entry", errStaleHint)
+		}
+		rest := make([]byte, int(binary.LittleEndian.Uint32(kl[:]))+21)
+		if _, err := io.ReadFull(in, rest); err != nil {
+			return 0, 0, fmt.Errorf("%w: truncated entry", errStaleHint)
+		}
+		key := string(rest[:len(rest)-21])
+		rest = rest[len(key):]
+		fn(hintEntry{
+			key: key,
+			recordInfo: recordInfo{
+				offset:    int64(binary.LittleEndian.Uint64(rest)),
+				size:      int64(binary.LittleEndian.Uint32(rest[8:])),
+				tombstone: rest[12]&flagTombstone != 0,
+				expiresAt: int64(binary.LittleEndian.Uint64(rest[13:])),
+			},
+		})
+	}
+	return covered, records, nil
+}
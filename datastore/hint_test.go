@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fillSegments(t *testing.T, dir string, n int) map[string]string {
+	db, err := OpenWithMaxSize(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records are appended directly so that no merge collapses the segments.
+	db.writeMutex.Lock()
+	expected := make(map[string]string)
+	for i := 0; i < n; i++ {
+		e := entry{key: fmt.Sprintf("key%d", i%7), value: fmt.Sprintf("value%d", i), tombstone: i%5 == 4}
+		if _, err := db.appendEntries([]entry{e}); err != nil {
+			t.Fatal(err)
+		}
+		if e.tombstone {
+			delete(expected, e.key)
+		} else {
+			expected[e.key] = e.value
+		}
+	}
+	db.writeMutex.Unlock()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return expected
+}
+
+func checkContents(t *testing.T, db Store, expected map[string]string) {
+	t.Helper()
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, err := db.Get(key)
+		if want, ok := expected[key]; ok {
+			if err != nil || value != want {
+				t.Errorf("Get(%q) = %q (%v), wanted %q", key, value, err, want)
+			}
+		} else if err != ErrNotFound {
+			t.Errorf("Get(%q) expected ErrNotFound, got %q (%v)", key, value, err)
+		}
+	}
+}
+
+func TestHintWrittenForSealedSegments(t *testing.T) {
+	tmp := t.TempDir()
+	expected := fillSegments(t, tmp, 30)
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(db.segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(db.segments))
+	}
+	for i, seg := range db.segments {
+		_, err := os.Stat(hintPath(seg.filePath))
+		if i < len(db.segments)-1 && err != nil {
+			t.Errorf("Missing hint for sealed segment %s: %s", seg.filePath, err)
+		}
+		if i == len(db.segments)-1 && err == nil {
+			t.Errorf("Unexpected hint for active segment %s", seg.filePath)
+		}
+	}
+	checkContents(t, db, expected)
+}
+
+func TestOpenUsesHints(t *testing.T) {
+	tmp := t.TempDir()
+	expected := fillSegments(t, tmp, 30)
+
+	// Corrupt a record in the middle of the first sealed segment: a full
+	// scan refuses to open it, while loading from the hint does not read it.
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[segmentHeaderSize+v1HeaderSize] ^= 0xFF
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatalf("Expected Open to load the index from hints, got %s", err)
+	}
+	db.Close()
+
+	if err := os.Remove(hintPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWithMaxSize(tmp, 100); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected full scan without hint to fail with ErrCorrupted, got %v", err)
+	}
+
+	data[segmentHeaderSize+v1HeaderSize] ^= 0xFF
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, expected)
+}
+
+func TestStaleHintFallsBackToScan(t *testing.T) {
+	tmp := t.TempDir()
+	expected := fillSegments(t, tmp, 30)
+	hint := hintPath(filepath.Join(tmp, outFileName))
+
+	data, err := os.ReadFile(hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("corrupted", func(t *testing.T) {
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)/2] ^= 0xFF
+		if err := os.WriteFile(hint, corrupted, 0600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenWithMaxSize(tmp, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		checkContents(t, db, expected)
+	})
+
+	t.Run("covers more than segment", func(t *testing.T) {
+		seg := &segment{fs: OSFS, filePath: filepath.Join(tmp, outFileName), size: 1 << 20, index: map[string]recordInfo{
+			"key0": {offset: 1000, size: 10},
+		}}
+		if err := writeHint(seg); err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenWithMaxSize(tmp, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		checkContents(t, db, expected)
+	})
+}
+
+func TestHintAfterMerge(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mergeSegments()
+
+	if _, err := os.Stat(hintPath(db.segments[0].filePath)); err != nil {
+		t.Fatalf("Missing hint for merged segment: %s", err)
+	}
+	if err := db.Put("key0", "after-merge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, map[string]string{
+		"key0": "after-merge",
+		"key1": "value7",
+		"key2": "value8",
+	})
+}
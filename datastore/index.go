@@ -0,0 +1,136 @@
+package datastore
+
+import "math/rand/v2"
+
+const maxIndexLevel = 24
+
+// keyIndex is an ordered map from keys to record locations. It is not safe
+// for concurrent use; Db guards it with mu, and only calls Get and Ascend
+// concurrently with each other.
+type keyIndex interface {
+	Get(key string) (segmentLocation, bool)
+	// Set and Delete return the location the key had before, if any.
+	Set(key string, loc segmentLocation) (segmentLocation, bool)
+	Delete(key string) (segmentLocation, bool)
+	Len() int
+	// Ascend calls fn for every key in [start, end) in order until fn
+	// returns false. An empty end means there is no upper bound.
+	Ascend(start, end string, fn func(key string, loc segmentLocation) bool)
+	// Err returns the first error the index ran into. An index that failed
+	// may have lost changes, so the Db can no longer be trusted.
+	Err() error
+	Close() error
+}
+
+// memIndex keeps every key in memory, in a skip list.
+type memIndex struct {
+	head  *indexNode
+	level int
+	len   int
+	rnd   *rand.Rand
+}
+
+type indexNode struct {
+	key  string
+	loc  segmentLocation
+	next []*indexNode
+}
+
+func newMemIndex() *memIndex {
+	return &memIndex{
+		head:  &indexNode{next: make([]*indexNode, maxIndexLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+	}
+}
+
+// findGreaterOrEqual returns the first node with a key not less than key,
+// filling prev with the last node before it on every level if not nil.
+func (ix *memIndex) findGreaterOrEqual(key string, prev []*indexNode) *indexNode {
+	node := ix.head
+	for level := ix.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (ix *memIndex) Get(key string) (segmentLocation, bool) {
+	node := ix.findGreaterOrEqual(key, nil)
+	if node == nil || node.key != key {
+		return segmentLocation{}, false
+	}
+	return node.loc, true
+}
+
+func (ix *memIndex) Set(key string, loc segmentLocation) (segmentLocation, bool) {
+	var prev [maxIndexLevel]*indexNode
+	node := ix.findGreaterOrEqual(key, prev[:])
+	if node != nil && node.key == key {
+		old := node.loc
+		node.loc = loc
+		return old, true
+	}
+
+	level := 1
+	for level < maxIndexLevel && ix.rnd.IntN(4) == 0 {
+		level++
+	}
+	if level > ix.level {
+		for i := ix.level; i < level; i++ {
+			prev[i] = ix.head
+		}
+		ix.level = level
+	}
+
+	node = &indexNode{key: key, loc: loc, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	ix.len++
+	return segmentLocation{}, false
+}
+
+func (ix *memIndex) Delete(key string) (segmentLocation, bool) {
+	var prev [maxIndexLevel]*indexNode
+	node := ix.findGreaterOrEqual(key, prev[:])
+	if node == nil || node.key != key {
+		return segmentLocation{}, false
+	}
+	for i := 0; i < len(node.next); i++ {
+		prev[i].next[i] = node.next[i]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.len--
+	return node.loc, true
+}
+
+func (ix *memIndex) Len() int {
+	return ix.len
+}
+
+func (ix *memIndex) Ascend(start, end string, fn func(key string, loc segmentLocation) bool) {
+	for node := ix.findGreaterOrEqual(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			return
+		}
+		if !fn(node.key, node.loc) {
+			return
+		}
+	}
+}
+
+func (ix *memIndex) Err() error {
+	return nil
+}
+
+func (ix *memIndex) Close() error {
+	return nil
+}
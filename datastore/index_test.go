@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	for name, kind := range map[string]IndexKind{"memory": IndexMemory, "disk": IndexDisk} {
+		t.Run(name, func(t *testing.T) {
+			var ix keyIndex = newMemIndex()
+			if kind == IndexDisk {
+				// A tiny buffer makes the disk index write and merge runs.
+				dix, err := newDiskIndex(NewMemFS(), "/db", 16)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ix = dix
+			}
+			defer ix.Close()
+			testKeyIndex(t, ix)
+			if err := ix.Err(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func testKeyIndex(t *testing.T, ix keyIndex) {
+	expected := make(map[string]int)
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%04d", rand.IntN(500))
+		if rand.IntN(3) == 0 {
+			ix.Delete(key)
+			delete(expected, key)
+		} else {
+			ix.Set(key, segmentLocation{segID: i})
+			expected[key] = i
+		}
+	}
+
+	if ix.Len() != len(expected) {
+		t.Errorf("Expected %d keys, got %d", len(expected), ix.Len())
+	}
+	for key, id := range expected {
+		loc, ok := ix.Get(key)
+		if !ok || loc.segID != id {
+			t.Errorf("Get(%q) = %v %v, wanted segment %d", key, loc, ok, id)
+		}
+	}
+
+	var keys []string
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var got []string
+	ix.Ascend("", "", func(key string, _ segmentLocation) bool {
+		got = append(got, key)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Errorf("Ascend returned keys out of order or incomplete")
+	}
+
+	got = got[:0]
+	ix.Ascend("key0100", "key0200", func(key string, _ segmentLocation) bool {
+		got = append(got, key)
+		return true
+	})
+	for _, key := range got {
+		if key < "key0100" || key >= "key0200" {
+			t.Errorf("Key %q outside of the requested range", key)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"abc":       "abd",
+		"ab\xff":    "ac",
+		"\xff\xff":  "",
+		"":          "",
+		"user:\xff": "user;",
+	} {
+		if end := PrefixEnd(prefix); end != expected {
+			t.Errorf("PrefixEnd(%q) = %q, wanted %q", prefix, end, expected)
+		}
+	}
+}
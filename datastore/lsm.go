@@ -0,0 +1,1022 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsmManifestName   = "LSM"
+	lsmManifestHeader = "kvs-lsm 1"
+	walPrefix         = "wal-"
+	tablePrefix       = "table-"
+	// lsmTierWidth is how many tables of a tier are merged into one table
+	// of the next tier.
+	lsmTierWidth = 4
+	// defaultTableFilterRate is the false positive rate of table filters
+	// unless WithBloomFilter sets another.
+	defaultTableFilterRate = 0.01
+)
+
+// LSM is a storage engine that keeps the latest writes in a memtable,
+// backed by a write-ahead log, and flushes it to an immutable table sorted
+// by key once the log reaches the maximum segment size. Only the memtable
+// and the sparse index and Bloom filter of every table are kept in memory.
+//
+// Tables are compacted size-tiered: flushed tables are in tier 0, and once
+// lsmTierWidth tables of a tier pile up they are merged into one table of
+// the next tier. A lookup checks the memtable and then the tables from the
+// newest one, reading at most one block of each table its filter lets
+// through.
+//
+// Flushes and merges run in the background. A full memtable is set aside
+// together with its log while writes go on to a new one, and the lock is
+// only held to swap the resulting table in.
+type LSM struct {
+	fs  FS
+	dir string
+	mu  sync.RWMutex
+	mem *memtable
+	// imm is the full memtable being flushed, if any.
+	imm        *memtable
+	tables     []*table // newest first
+	nextID     int
+	maxSize    int64
+	syncPolicy SyncPolicy
+	filterRate float64
+	closed     bool
+	done       chan struct{}
+	now        func() time.Time
+
+	// compactMu serialises flushes and merges. Only they remove tables, so
+	// the tables they work on stay in place while mu is not held.
+	compactMu sync.Mutex
+	// interrupt, if set, is asked before every flush and merge whether to
+	// stop right there, leaving the files as a crash at that point would.
+	interrupt func(step string) bool
+
+	mergeCount        int
+	lastMerge         time.Time
+	lastMergeDuration time.Duration
+}
+
+// memtable holds the latest writes together with the write-ahead log they
+// are in.
+type memtable struct {
+	records map[string]entry
+	wal     File
+	walName string
+	size    int64
+	count   int64
+	// liveKeys and liveBytes count the records that are not deletions.
+	liveKeys, liveBytes int64
+}
+
+func (m *memtable) set(e entry) {
+	if old, ok := m.records[e.key]; ok && !old.tombstone {
+		m.liveKeys--
+		m.liveBytes -= int64(old.encodedSize())
+	}
+	e.continued = false
+	m.records[e.key] = e
+	if !e.tombstone {
+		m.liveKeys++
+		m.liveBytes += int64(e.encodedSize())
+	}
+}
+
+// OpenLSM opens the LSM store in dir, creating it if needed. It takes the
+// options of Open that apply to it, WithMaxSize setting the size of the
+// write-ahead log at which the memtable is flushed, and refuses
+// compression, caching, disk indexes and the replication log, which only
+// Open supports.
+func OpenLSM(dir string, opts ...Option) (*LSM, error) {
+	o := newOptions(opts)
+	if o.bloomRate < 0 || o.bloomRate >= 1 {
+		return nil, fmt.Errorf("bloom filter false positive rate must be in [0, 1), got %g", o.bloomRate)
+	}
+	var unsupported string
+	switch {
+	case o.compressAbove != 0:
+		unsupported = "compression"
+	case o.cacheSize != 0:
+		unsupported = "a cache"
+	case o.index != IndexMemory:
+		unsupported = "a disk index"
+	case o.replicationLog != 0:
+		unsupported = "a replication log"
+	}
+	if unsupported != "" {
+		return nil, fmt.Errorf("the LSM engine does not support %s", unsupported)
+	}
+	if err := o.fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := o.fs.Stat(filepath.Join(dir, manifestFileName)); err == nil {
+		return nil, fmt.Errorf("%s holds a log-structured database", dir)
+	}
+
+	l := &LSM{
+		fs:         o.fs,
+		dir:        dir,
+		maxSize:    o.maxSize,
+		syncPolicy: o.syncPolicy,
+		filterRate: o.bloomRate,
+		done:       make(chan struct{}),
+		now:        time.Now,
+	}
+	if l.filterRate == 0 {
+		l.filterRate = defaultTableFilterRate
+	}
+	if err := l.recover(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if l.syncPolicy == SyncInterval {
+		go l.syncer(o.syncInterval)
+	}
+	if l.imm != nil {
+		l.maybeCompact()
+	}
+	return l, nil
+}
+
+func (l *LSM) recover() error {
+	walNames, tableNames, err := readLSMManifest(l.fs, l.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		l.mem, err = l.createWAL()
+		if err == nil {
+			err = writeLSMManifest(l.fs, l.dir, l.walNamesLocked(), nil)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool)
+	for _, name := range append(walNames, tableNames...) {
+		live[name] = true
+	}
+	files, err := l.fs.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		base := strings.TrimSuffix(name, ".tmp")
+		if _, ok := parseLSMName(base); ok && !live[base] || base == lsmManifestName && name != base {
+			if err := l.fs.Remove(filepath.Join(l.dir, name)); err != nil {
+				return err
+			}
+			log.Printf("datastore: removed %s which is not listed in the manifest", name)
+		}
+	}
+
+	for _, name := range tableNames {
+		t, err := openTable(l.fs, filepath.Join(l.dir, name))
+		if err != nil {
+			return err
+		}
+		t.name = name
+		l.tables = append(l.tables, t)
+	}
+	for name := range live {
+		if id, _ := parseLSMName(name); id >= l.nextID {
+			l.nextID = id + 1
+		}
+	}
+	// A second log backs the memtable that was being flushed.
+	if len(walNames) > 1 {
+		if l.imm, err = l.replayWAL(walNames[1]); err != nil {
+			return err
+		}
+	}
+	l.mem, err = l.replayWAL(walNames[0])
+	return err
+}
+
+// replayWAL loads the records of a write-ahead log into a memtable. A
+// batch cut short by a crash is discarded as a whole.
+func (l *LSM) replayWAL(name string) (*memtable, error) {
+	path := filepath.Join(l.dir, name)
+	f, err := l.fs.OpenFile(path, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &memtable{records: make(map[string]entry), wal: f, walName: name}
+	if err := m.replay(path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *memtable) replay(path string) error {
+	info, err := m.wal.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	in := bufio.NewReader(io.NewSectionReader(m.wal, 0, size))
+	_, headerSize, err := readSegmentHeader(in)
+	if err != nil {
+		return fmt.Errorf("log %s: %w", path, err)
+	}
+	offset := int64(headerSize)
+	var batch []entry
+	batchStart := offset
+	for {
+		var record entry
+		n, err := record.decodeFromReader(in, currentFormat)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if isTornRecord(err, offset+int64(n), size) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("log %s at offset %d: %w", path, offset, err)
+		}
+		offset += int64(n)
+		batch = append(batch, record)
+		if !record.continued {
+			for _, e := range batch {
+				m.set(e)
+			}
+			m.count += int64(len(batch))
+			batch = batch[:0]
+			batchStart = offset
+		}
+	}
+	if batchStart < size {
+		if err := m.wal.Truncate(batchStart); err != nil {
+			return fmt.Errorf("failed to truncate log %s: %w", path, err)
+		}
+		log.Printf("datastore: discarded %d bytes of torn data at the end of %s", size-batchStart, path)
+	}
+	m.size = batchStart
+	return nil
+}
+
+func (l *LSM) syncer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.RLock()
+			if !l.closed {
+				if err := l.mem.wal.Sync(); err != nil {
+					log.Printf("datastore: failed to sync %s: %s", l.mem.walName, err)
+				}
+			}
+			l.mu.RUnlock()
+		}
+	}
+}
+
+func (l *LSM) Get(key string) (string, error) {
+	e, err := l.get(key)
+	if err != nil {
+		return "", err
+	}
+	if e.valueType != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return e.value, nil
+}
+
+func (l *LSM) GetInt64(key string) (int64, error) {
+	e, err := l.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if e.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return e.int64(), nil
+}
+
+func (l *LSM) get(key string) (entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return entry{}, errClosed
+	}
+	return l.getLocked(key)
+}
+
+// getLocked returns the live record of key. The caller must hold mu.
+func (l *LSM) getLocked(key string) (entry, error) {
+	e, ok := l.mem.records[key]
+	if !ok && l.imm != nil {
+		e, ok = l.imm.records[key]
+	}
+	if !ok {
+		h1, h2 := bloomHash(key)
+		for _, t := range l.tables {
+			var err error
+			if e, ok, err = t.get(key, h1, h2); err != nil {
+				return entry{}, fmt.Errorf("table %s: %w", t.name, err)
+			} else if ok {
+				break
+			}
+		}
+	}
+	if !ok || e.tombstone || e.expired(l.now()) {
+		return entry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func (l *LSM) Put(key, value string) error {
+	return l.put(entry{key: key, value: value})
+}
+
+func (l *LSM) PutInt64(key string, value int64) error {
+	return l.put(int64Entry(key, value))
+}
+
+func (l *LSM) Increment(key string, delta int64) (int64, error) {
+	var n int64
+	err := l.update(key, func(e entry, err error) (entry, error) {
+		var next entry
+		next, n, err = applyIncrement(key, e, err, delta)
+		return next, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (l *LSM) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return l.put(entry{key: key, value: value, expiresAt: l.now().Add(ttl).UnixNano()})
+}
+
+func (l *LSM) CompareAndSwap(key, expected, value string) error {
+	return l.update(key, func(e entry, err error) (entry, error) {
+		if err := checkSwap(e, err, expected); err != nil {
+			return entry{}, err
+		}
+		return entry{key: key, value: value}, nil
+	})
+}
+
+func (l *LSM) PutIfAbsent(key, value string) error {
+	return l.update(key, func(_ entry, err error) (entry, error) {
+		if err := checkAbsent(err); err != nil {
+			return entry{}, err
+		}
+		return entry{key: key, value: value}, nil
+	})
+}
+
+func (l *LSM) Delete(key string) error {
+	return l.update(key, func(_ entry, err error) (entry, error) {
+		if err != nil {
+			return entry{}, err
+		}
+		return entry{key: key, tombstone: true}, nil
+	})
+}
+
+// update writes the record fn derives from the current one of key.
+func (l *LSM) update(key string, fn func(current entry, err error) (entry, error)) error {
+	if err := (&entry{key: key}).validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errClosed
+	}
+
+	e, err := fn(l.getLocked(key))
+	if err != nil {
+		return err
+	}
+	if err := e.validate(); err != nil {
+		return err
+	}
+	return l.writeLocked([]entry{e})
+}
+
+// put writes e without looking up the current record of its key.
+func (l *LSM) put(e entry) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errClosed
+	}
+	return l.writeLocked([]entry{e})
+}
+
+func (l *LSM) WriteBatch(b *Batch) error {
+	for _, op := range b.ops {
+		if err := op.validate(); err != nil {
+			return err
+		}
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errClosed
+	}
+	return l.writeLocked(b.ops)
+}
+
+// writeLocked appends the entries to the write-ahead log as one batch and
+// applies them to the memtable, starting a flush in the background once
+// the log has grown too large. The caller must hold mu.
+func (l *LSM) writeLocked(entries []entry) error {
+	var buf []byte
+	for i, e := range entries {
+		e.continued = i < len(entries)-1
+		buf = append(buf, e.Encode()...)
+	}
+	n, err := l.mem.wal.Write(buf)
+	if err != nil {
+		if n > 0 {
+			if terr := l.mem.wal.Truncate(l.mem.size); terr != nil {
+				log.Printf("datastore: failed to discard partial write to %s: %s", l.mem.walName, terr)
+			}
+		}
+		return err
+	}
+	l.mem.size += int64(n)
+	l.mem.count += int64(len(entries))
+	if l.syncPolicy == SyncAlways || l.syncPolicy == SyncBatch {
+		if err := l.mem.wal.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		l.mem.set(e)
+	}
+
+	if l.mem.size >= l.maxSize {
+		l.maybeCompact()
+	}
+	return nil
+}
+
+// maybeCompact flushes and merges in the background unless that is going
+// on already.
+func (l *LSM) maybeCompact() {
+	if !l.compactMu.TryLock() {
+		return
+	}
+	go func() {
+		defer l.compactMu.Unlock()
+		if err := l.compactLocked(); err != nil {
+			log.Printf("datastore: compaction failed: %s", err)
+		}
+	}()
+}
+
+// compactLocked flushes the memtable for as long as its log is full and
+// then merges every tier that is due. The caller must hold compactMu.
+func (l *LSM) compactLocked() error {
+	for {
+		l.mu.Lock()
+		var err error
+		if l.imm == nil && l.mem.size >= l.maxSize {
+			err = l.rotateLocked()
+		}
+		pending := l.imm != nil
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !pending {
+			break
+		}
+		if err := l.flush(); err != nil {
+			return err
+		}
+	}
+	return l.compactTiers()
+}
+
+// rotateLocked sets the memtable aside to be flushed and starts a new one
+// with an empty write-ahead log. The caller must hold mu, and no other
+// memtable may be waiting for a flush.
+func (l *LSM) rotateLocked() error {
+	m, err := l.createWAL()
+	if err != nil {
+		return err
+	}
+	if err := writeLSMManifest(l.fs, l.dir, []string{m.walName, l.mem.walName}, l.tables); err != nil {
+		m.wal.Close()
+		l.fs.Remove(filepath.Join(l.dir, m.walName))
+		return err
+	}
+	l.imm, l.mem = l.mem, m
+	return nil
+}
+
+// createWAL creates an empty write-ahead log for a new memtable. The caller
+// must hold mu unless the store is not shared yet.
+func (l *LSM) createWAL() (*memtable, error) {
+	name := fmt.Sprintf("%s%d", walPrefix, l.nextID)
+	l.nextID++
+	path := filepath.Join(l.dir, name)
+	f, err := l.fs.OpenFile(path, os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(encodeSegmentHeader(currentFormat))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		l.fs.Remove(path)
+		return nil, err
+	}
+	return &memtable{records: make(map[string]entry), wal: f, walName: name, size: segmentHeaderSize}, nil
+}
+
+// walNamesLocked returns the write-ahead logs the manifest lists. The
+// caller must hold mu.
+func (l *LSM) walNamesLocked() []string {
+	names := []string{l.mem.walName}
+	if l.imm != nil {
+		names = append(names, l.imm.walName)
+	}
+	return names
+}
+
+// flush writes the memtable set aside to a new table and then swaps the
+// table in for it. The caller must hold compactMu.
+func (l *LSM) flush() error {
+	l.mu.Lock()
+	imm := l.imm
+	// Deletions only matter while an older table may hold the key.
+	keepDeletions := len(l.tables) > 0
+	name := fmt.Sprintf("%s%d", tablePrefix, l.nextID)
+	l.nextID++
+	l.mu.Unlock()
+
+	if l.interrupted("flush") {
+		return errMergeInterrupted
+	}
+	records := make([]entry, 0, len(imm.records))
+	for _, e := range imm.records {
+		if !e.tombstone || keepDeletions {
+			records = append(records, e)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+
+	t, err := writeTable(l.fs, filepath.Join(l.dir, name), 0, int64(len(records)), l.filterRate, func(add func(entry) error) error {
+		for _, e := range records {
+			if err := add(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.name = name
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tables := append([]*table{t}, l.tables...)
+	if err := writeLSMManifest(l.fs, l.dir, []string{l.mem.walName}, tables); err != nil {
+		t.file.Close()
+		l.fs.Remove(filepath.Join(l.dir, name))
+		return err
+	}
+	l.tables, l.imm = tables, nil
+	imm.wal.Close()
+	l.fs.Remove(filepath.Join(l.dir, imm.walName))
+	return nil
+}
+
+// compactTiers merges the tables of every tier that has lsmTierWidth of
+// them, from the lowest tier up. Tables are ordered by tier as well as by
+// age, so those of a tier are next to each other. The caller must hold
+// compactMu.
+func (l *LSM) compactTiers() error {
+	for {
+		l.mu.RLock()
+		group := dueTier(l.tables)
+		l.mu.RUnlock()
+		if group == nil {
+			return nil
+		}
+		if err := l.mergeTables(group, group[0].tier+1); err != nil {
+			return err
+		}
+	}
+}
+
+// dueTier returns the tables of the lowest tier that has lsmTierWidth of
+// them, or nil if there is none.
+func dueTier(tables []*table) []*table {
+	for start := 0; start < len(tables); {
+		end := start + 1
+		for end < len(tables) && tables[end].tier == tables[start].tier {
+			end++
+		}
+		if end-start >= lsmTierWidth {
+			return append([]*table(nil), tables[start:end]...)
+		}
+		start = end
+	}
+	return nil
+}
+
+// mergeTables replaces group, which are next to each other in the tables,
+// with a single table of the given tier. Deletions and expired records are
+// dropped once no older table is left that they could hide a record in.
+// The tables are read without holding mu; flushes only add newer tables
+// meanwhile. The caller must hold compactMu.
+func (l *LSM) mergeTables(group []*table, tier int) error {
+	started := time.Now()
+	l.mu.Lock()
+	bottom := group[len(group)-1] == l.tables[len(l.tables)-1]
+	now := l.now()
+	name := fmt.Sprintf("%s%d", tablePrefix, l.nextID)
+	l.nextID++
+	l.mu.Unlock()
+
+	if l.interrupted("merge") {
+		return errMergeInterrupted
+	}
+	var count int64
+	cursors := make([]*entryCursor, len(group))
+	for i, t := range group {
+		count += t.count
+		cursors[i] = t.cursor("")
+	}
+	merged, err := writeTable(l.fs, filepath.Join(l.dir, name), tier, count, l.filterRate, func(add func(entry) error) error {
+		var err error
+		merr := mergeCursors(cursors, "", func(e entry) bool {
+			if bottom && (e.tombstone || e.expired(now)) {
+				return true
+			}
+			err = add(e)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return merr
+	})
+	if err != nil {
+		return err
+	}
+	merged.name = name
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := slices.Index(l.tables, group[0])
+	tables := append(append(append([]*table(nil), l.tables[:start]...), merged), l.tables[start+len(group):]...)
+	if err := writeLSMManifest(l.fs, l.dir, l.walNamesLocked(), tables); err != nil {
+		merged.file.Close()
+		l.fs.Remove(filepath.Join(l.dir, name))
+		return err
+	}
+	for _, t := range group {
+		t.file.Close()
+		l.fs.Remove(filepath.Join(l.dir, t.name))
+	}
+	l.tables = tables
+	l.mergeCount++
+	l.lastMerge = l.now()
+	l.lastMergeDuration = time.Since(started)
+	return nil
+}
+
+func (l *LSM) interrupted(step string) bool {
+	return l.interrupt != nil && l.interrupt(step)
+}
+
+// Compact flushes the memtable and merges all tables into one, dropping
+// every deleted, overwritten and expired record. Writes go on meanwhile.
+func (l *LSM) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	// A memtable already set aside takes the first round, the current one
+	// the second.
+	for i := 0; i < 2; i++ {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return errClosed
+		}
+		var err error
+		if l.imm == nil && len(l.mem.records) > 0 {
+			err = l.rotateLocked()
+		}
+		pending := l.imm != nil
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if pending {
+			if err := l.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	l.mu.RLock()
+	group := append([]*table(nil), l.tables...)
+	l.mu.RUnlock()
+	if len(group) <= 1 {
+		return nil
+	}
+	return l.mergeTables(group, group[len(group)-1].tier)
+}
+
+// cursorsLocked returns cursors at start over the memtables and every
+// table, newest first. The caller must hold mu.
+func (l *LSM) cursorsLocked(start, end string) []*entryCursor {
+	var cursors []*entryCursor
+	for _, m := range []*memtable{l.mem, l.imm} {
+		if m == nil {
+			continue
+		}
+		var pending []entry
+		for key, e := range m.records {
+			if key >= start && (end == "" || key < end) {
+				pending = append(pending, e)
+			}
+		}
+		sort.Slice(pending, func(i, j int) bool { return pending[i].key < pending[j].key })
+		c := &entryCursor{pending: pending}
+		c.next()
+		cursors = append(cursors, c)
+	}
+	for _, t := range l.tables {
+		cursors = append(cursors, t.cursor(start))
+	}
+	return cursors
+}
+
+// Scan returns an iterator over the live keys in [start, end). The records
+// are read when the scan starts, so later writes do not change it.
+func (l *LSM) Scan(start, end string) *Iterator {
+	return l.ScanLimit(start, end, 0)
+}
+
+// ScanLimit is like Scan but stops reading after limit keys if limit is
+// positive.
+func (l *LSM) ScanLimit(start, end string, limit int) *Iterator {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	it := &Iterator{}
+	if l.closed {
+		it.err = errClosed
+		return it
+	}
+	now := l.now()
+	it.err = mergeCursors(l.cursorsLocked(start, end), end, func(e entry) bool {
+		if !e.tombstone && !e.expired(now) {
+			it.items = append(it.items, scanItem{key: e.key, record: &e})
+		}
+		return limit <= 0 || len(it.items) < limit
+	})
+	return it
+}
+
+func (l *LSM) ScanPrefix(prefix string) *Iterator {
+	return l.Scan(prefix, PrefixEnd(prefix))
+}
+
+// Stats reports the write-ahead logs and every table as a segment. Each of
+// them only knows its own records, not the ones a newer segment overwrites
+// or deletes, so the live and dead counts are left unset unless a single
+// segment holds records, as after Compact. Expired records count as live
+// until a merge drops them.
+func (l *LSM) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := Stats{
+		MergeCount:        l.mergeCount,
+		LastMerge:         l.lastMerge,
+		LastMergeDuration: l.lastMergeDuration,
+	}
+	if l.closed {
+		return stats
+	}
+	for _, m := range []*memtable{l.mem, l.imm} {
+		if m != nil {
+			stats.Segments = append(stats.Segments, SegmentStats{
+				Name:       m.walName,
+				TotalBytes: m.size,
+				LiveKeys:   m.liveKeys,
+				LiveBytes:  m.liveBytes,
+				DeadKeys:   m.count - m.liveKeys,
+				DeadBytes:  m.size - segmentHeaderSize - m.liveBytes,
+			})
+		}
+	}
+	for _, t := range l.tables {
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name:       t.name,
+			TotalBytes: t.size,
+			LiveKeys:   t.count - t.deletions,
+			LiveBytes:  t.dataSize - segmentHeaderSize - t.deletedBytes,
+			DeadKeys:   t.deletions,
+			DeadBytes:  t.deletedBytes,
+		})
+	}
+
+	holding := 0
+	for _, s := range stats.Segments {
+		if s.LiveKeys+s.DeadKeys > 0 {
+			holding++
+		}
+	}
+	for i, s := range stats.Segments {
+		stats.TotalBytes += s.TotalBytes
+		if holding > 1 {
+			stats.Segments[i] = SegmentStats{Name: s.Name, TotalBytes: s.TotalBytes}
+			continue
+		}
+		stats.LiveKeys += int(s.LiveKeys)
+		stats.LiveBytes += s.LiveBytes
+		stats.DeadBytes += s.DeadBytes
+	}
+	if holding <= 1 && stats.TotalBytes > 0 {
+		stats.GarbageRatio = float64(stats.DeadBytes) / float64(stats.TotalBytes)
+	}
+	return stats
+}
+
+// Snapshot writes a consistent copy of the store to dir, which must be
+// empty or not exist yet. Tables are hard-linked when possible; writes
+// wait while the write-ahead logs are copied.
+func (l *LSM) Snapshot(dir string) error {
+	if files, err := l.fs.ReadDir(dir); err == nil && len(files) > 0 {
+		return fmt.Errorf("snapshot directory %s is not empty", dir)
+	}
+	if err := l.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return errClosed
+	}
+
+	for _, t := range l.tables {
+		if err := linkOrCopy(l.fs, filepath.Join(l.dir, t.name), filepath.Join(dir, t.name)); err != nil {
+			return err
+		}
+	}
+	for _, m := range []*memtable{l.mem, l.imm} {
+		if m == nil {
+			continue
+		}
+		if err := copyFile(l.fs, filepath.Join(l.dir, m.walName), filepath.Join(dir, m.walName), m.size); err != nil {
+			return err
+		}
+	}
+	return writeLSMManifest(l.fs, dir, l.walNamesLocked(), l.tables)
+}
+
+func (l *LSM) Size() (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var total int64
+	for _, m := range []*memtable{l.mem, l.imm} {
+		if m != nil {
+			total += m.size
+		}
+	}
+	for _, t := range l.tables {
+		total += t.size
+	}
+	return total, nil
+}
+
+// Close waits for a flush or merge in progress to finish.
+func (l *LSM) Close() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+
+	var firstErr error
+	if l.mem != nil && l.syncPolicy != SyncNever {
+		if err := l.mem.wal.Sync(); err != nil {
+			firstErr = fmt.Errorf("failed to sync log %s: %w", l.mem.walName, err)
+		}
+	}
+	for _, m := range []*memtable{l.mem, l.imm} {
+		if m == nil {
+			continue
+		}
+		if err := m.wal.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, t := range l.tables {
+		if err := t.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// The LSM manifest names the write-ahead logs after the header, the
+// current one first and then the one of a memtable being flushed, if any,
+// followed by the tables, newest first. Like the manifest of a Db, it is
+// replaced atomically whenever they change.
+
+func readLSMManifest(fsys FS, dir string) ([]string, []string, error) {
+	data, err := readFile(fsys, filepath.Join(dir, lsmManifestName))
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) < 2 || lines[0] != lsmManifestHeader {
+		return nil, nil, fmt.Errorf("%s: unknown manifest format", lsmManifestName)
+	}
+	for _, name := range lines[1:] {
+		if _, ok := parseLSMName(name); !ok {
+			return nil, nil, fmt.Errorf("%s: invalid file name %q", lsmManifestName, name)
+		}
+	}
+	wals := 0
+	for wals < len(lines)-1 && wals < 2 && strings.HasPrefix(lines[1+wals], walPrefix) {
+		wals++
+	}
+	if wals == 0 {
+		return nil, nil, fmt.Errorf("%s: no log", lsmManifestName)
+	}
+	return lines[1 : 1+wals], lines[1+wals:], nil
+}
+
+func writeLSMManifest(fsys FS, dir string, walNames []string, tables []*table) error {
+	var buf bytes.Buffer
+	buf.WriteString(lsmManifestHeader + "\n")
+	for _, name := range walNames {
+		buf.WriteString(name + "\n")
+	}
+	for _, t := range tables {
+		buf.WriteString(t.name + "\n")
+	}
+
+	path := filepath.Join(dir, lsmManifestName)
+	tmpPath := path + ".tmp"
+	err := writeFile(fsys, tmpPath, buf.Bytes(), true)
+	if err == nil {
+		err = fsys.Rename(tmpPath, path)
+	}
+	if err != nil {
+		fsys.Remove(tmpPath)
+		return err
+	}
+	return fsys.SyncDir(dir)
+}
+
+func parseLSMName(name string) (int, bool) {
+	for _, prefix := range []string{walPrefix, tablePrefix} {
+		if strings.HasPrefix(name, prefix) {
+			id, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+			return id, err == nil
+		}
+	}
+	return 0, false
+}
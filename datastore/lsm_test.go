@@ -0,0 +1,414 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// settle waits for the background flushes and merges to catch up with the
+// writes made so far.
+func settle(l *LSM) {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	if err := l.compactLocked(); err != nil {
+		panic(err)
+	}
+}
+
+func TestLSM(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLSM(dir, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { l.Close() }()
+
+	// Waiting for the background work after every write flushes the
+	// memtable whenever its log fills up, so that tiers pile up.
+	expected := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key, value := fmt.Sprintf("key%d", i%7), fmt.Sprintf("value%d", i)
+		if err := l.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		settle(l)
+		expected[key] = value
+	}
+	if err := l.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "key3")
+	if err := l.Delete("key3"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting a missing key, got %v", err)
+	}
+	if n, err := l.Increment("counter", 5); err != nil || n != 5 {
+		t.Errorf("Increment = %d (%v), wanted 5", n, err)
+	}
+	if _, err := l.Increment("key0", 1); err != ErrTypeMismatch {
+		t.Errorf("Expected ErrTypeMismatch, got %v", err)
+	}
+	if err := l.PutIfAbsent("key0", "x"); err != ErrExists {
+		t.Errorf("Expected ErrExists, got %v", err)
+	}
+	if err := l.CompareAndSwap("key0", "stale", "x"); err != ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	if s := l.Stats(); len(s.Segments) < 2 || s.MergeCount == 0 {
+		t.Errorf("Expected flushed and compacted tables, got %d segments and %d merges", len(s.Segments), s.MergeCount)
+	}
+	checkContents(t, l, expected)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLSM(dir, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, l, expected)
+	if n, err := l.GetInt64("counter"); err != nil || n != 5 {
+		t.Errorf("GetInt64 = %d (%v) after reopening, wanted 5", n, err)
+	}
+
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, l, expected)
+	s := l.Stats()
+	if len(s.Segments) != 2 || s.LiveKeys != 7 || s.DeadBytes != 0 {
+		t.Errorf("Expected the log and one table with 7 live keys and no dead bytes, got %+v", s)
+	}
+
+	if _, err := Open(dir); err == nil {
+		t.Error("Expected Open to refuse an LSM directory")
+	}
+}
+
+func checkLSMFiles(t *testing.T, dir string) {
+	t.Helper()
+	walNames, tableNames, err := readLSMManifest(OSFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := map[string]bool{lsmManifestName: true}
+	for _, name := range append(walNames, tableNames...) {
+		allowed[name] = true
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !allowed[file.Name()] {
+			t.Errorf("Unexpected file %s, manifest lists %v and %v", file.Name(), walNames, tableNames)
+		}
+	}
+}
+
+func TestLSMWritesDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLSM(dir, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { l.Close() }()
+
+	paused, resume := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	l.interrupt = func(step string) bool {
+		if step == "merge" {
+			once.Do(func() {
+				close(paused)
+				<-resume
+			})
+		}
+		return false
+	}
+	expected := make(map[string]string)
+	put := func(key, value string) {
+		t.Helper()
+		if err := l.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	for i := 0; ; i++ {
+		select {
+		case <-paused:
+		default:
+			if i == 100000 {
+				t.Fatal("No merge started")
+			}
+			put(fmt.Sprintf("key%02d", i%50), fmt.Sprintf("value%d", i))
+			continue
+		}
+		break
+	}
+
+	// The merge is under way, which must not hold back reads and writes.
+	for i := 0; i < 100; i++ {
+		put(fmt.Sprintf("key%02d", i%60), "during")
+	}
+	if err := l.Delete("key00"); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "key00")
+	checkContents(t, l, expected)
+	if s := l.Stats(); s.MergeCount != 0 {
+		t.Errorf("Expected the merge to be still going on, got %d merges", s.MergeCount)
+	}
+	close(resume)
+
+	settle(l)
+	if s := l.Stats(); s.MergeCount == 0 {
+		t.Error("Expected the merge to finish")
+	}
+	checkContents(t, l, expected)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkLSMFiles(t, dir)
+	l, err = OpenLSM(dir, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, l, expected)
+}
+
+func TestLSMFlushInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLSM(dir, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.interrupt = func(step string) bool { return step == "flush" }
+	expected := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key, value := fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)
+		if err := l.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	l.compactMu.Lock()
+	err = l.compactLocked()
+	l.compactMu.Unlock()
+	if err != errMergeInterrupted {
+		t.Fatalf("Expected the flush to be interrupted, got %v", err)
+	}
+	if l.imm == nil {
+		t.Fatal("Expected a memtable waiting for its flush")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The memtable set aside is read back from its own log and flushed.
+	l, err = OpenLSM(dir, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkContents(t, l, expected)
+	settle(l)
+	if l.imm != nil || len(l.tables) == 0 {
+		t.Errorf("Expected the memtable to be flushed after reopening, got %d tables", len(l.tables))
+	}
+	checkContents(t, l, expected)
+	checkLSMFiles(t, dir)
+}
+
+func TestLSMRefusesLogOptions(t *testing.T) {
+	for _, opt := range []Option{WithCompression(100), WithCache(1024), WithIndex(IndexDisk), WithReplicationLog(10)} {
+		if l, err := OpenLSM(t.TempDir(), opt); err == nil {
+			l.Close()
+			t.Errorf("Expected OpenLSM to refuse an option it would ignore")
+		}
+	}
+}
+
+func TestLSMTornLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Put("b", "2")
+	b.Put("c", "3")
+	if err := l.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	walPath, walSize := filepath.Join(dir, l.mem.walName), l.mem.size
+	l.Close()
+
+	// Cutting the batch short drops all of it.
+	if err := os.Truncate(walPath, walSize-3); err != nil {
+		t.Fatal(err)
+	}
+	l, err = OpenLSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if v, err := l.Get("a"); err != nil || v != "1" {
+		t.Errorf("Get(a) = %q (%v), wanted 1", v, err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, err := l.Get(key); err != ErrNotFound {
+			t.Errorf("Expected %s of the torn batch to be gone, got %v", key, err)
+		}
+	}
+	if err := l.Put("d", "4"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLSMScanSkipsMissingFirstKey(t *testing.T) {
+	l, err := OpenLSM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c", "x2", "x3"} {
+		if err := l.Put(key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PutWithTTL("x1", "short", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+
+	scan := func(it *Iterator) string {
+		t.Helper()
+		defer it.Close()
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(keys)
+	}
+	if keys := scan(l.Scan("", "c")); keys != "[b]" {
+		t.Errorf("Expected the scan to go on past the deleted first key, got %v", keys)
+	}
+	if keys := scan(l.ScanPrefix("x")); keys != "[x2 x3]" {
+		t.Errorf("Expected the scan to go on past the expired first key, got %v", keys)
+	}
+	if keys := scan(l.ScanLimit("", "", 2)); keys != "[b c]" {
+		t.Errorf("Unexpected limited scan: %v", keys)
+	}
+}
+
+func TestLSMStatsOverwrites(t *testing.T) {
+	l, err := OpenLSM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := l.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// The table still holds the old value, which must not count as live.
+	if err := l.Put("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if s := l.Stats(); s.LiveKeys != 0 || s.DeadBytes != 0 || s.GarbageRatio != 0 {
+		t.Errorf("Expected the counts unset while the log overwrites a key in a table, got %+v", s)
+	}
+
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s := l.Stats(); s.LiveKeys != 1 || s.DeadBytes != 0 || s.GarbageRatio != 0 {
+		t.Errorf("Expected 1 live key and no dead bytes after Compact, got %+v", s)
+	}
+	if err := l.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if s := l.Stats(); s.LiveKeys != 0 || s.DeadBytes != 0 {
+		t.Errorf("Expected the counts unset while the log deletes a key in a table, got %+v", s)
+	}
+}
+
+func TestLSMScanAndSnapshot(t *testing.T) {
+	l, err := OpenLSM(t.TempDir(), WithMaxSize(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 40; i++ {
+		if err := l.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Delete("key05"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PutWithTTL("key06", "short", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PutInt64("key07", 7); err != nil {
+		t.Fatal(err)
+	}
+	settle(l)
+	now = now.Add(time.Minute)
+
+	it := l.ScanPrefix("key0")
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		if it.Key() == "key07" && it.Int64() != 7 {
+			t.Errorf("Expected key07 to hold 7, got %d", it.Int64())
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[key00 key01 key02 key03 key04 key07 key08 key09]" {
+		t.Errorf("Unexpected scan: %v", keys)
+	}
+
+	snapDir := filepath.Join(t.TempDir(), "snap")
+	if err := l.Snapshot(snapDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("key00", "after"); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := OpenLSM(snapDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if v, err := snap.Get("key00"); err != nil || v != "value0" {
+		t.Errorf("Snapshot Get(key00) = %q (%v), wanted value0", v, err)
+	}
+	if _, err := snap.Get("key05"); err != ErrNotFound {
+		t.Errorf("Expected key05 deleted in the snapshot, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	manifestFileName = "MANIFEST"
+	manifestHeader   = "kvs-manifest 1"
+	mergeTempName    = "merge-temp"
+)
+
+// The manifest lists the live segment files, oldest first, one per line
+// after the header line. It is replaced atomically whenever the set of
+// segments changes, so after a crash any segment file it does not list is
+// a leftover of an unfinished merge or rollover and can be removed.
+
+func readManifest(fsys FS, dir string) ([]string, error) {
+	data, err := readFile(fsys, filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		return nil, fmt.Errorf("%s: unknown manifest format", manifestFileName)
+	}
+	var names []string
+	for scanner.Scan() {
+		name := scanner.Text()
+		if _, ok := parseSegmentName(name); !ok {
+			return nil, fmt.Errorf("%s: invalid segment name %q", manifestFileName, name)
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+func writeManifest(fsys FS, dir string, segments []*segment) error {
+	var buf bytes.Buffer
+	buf.WriteString(manifestHeader + "\n")
+	for _, seg := range segments {
+		buf.WriteString(filepath.Base(seg.filePath) + "\n")
+	}
+
+	path := filepath.Join(dir, manifestFileName)
+	tmpPath := path + ".tmp"
+	err := writeFile(fsys, tmpPath, buf.Bytes(), true)
+	if err == nil {
+		err = fsys.Rename(tmpPath, path)
+	}
+	if err != nil {
+		fsys.Remove(tmpPath)
+		return err
+	}
+	return fsys.SyncDir(dir)
+}
+
+func parseSegmentName(name string) (int, bool) {
+	if name == outFileName {
+		return 0, true
+	}
+	if !strings.HasPrefix(name, segmentPrefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(name, segmentPrefix))
+	return id, err == nil
+}
+
+// removeUnlisted deletes segment files, hints, filters and temporary files that
+// the manifest does not reference, and leftover disk indexes.
+func removeUnlisted(fsys FS, dir string, live map[string]bool) error {
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() && strings.HasPrefix(name, indexDirPrefix) {
+			// Disk indexes are rebuilt on every open.
+			if err := fsys.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		base := strings.TrimSuffix(name, ".tmp")
+		base = strings.TrimSuffix(strings.TrimSuffix(base, hintSuffix), bloomSuffix)
+		_, isSegment := parseSegmentName(base)
+		if name == mergeTempName || name == manifestFileName+".tmp" || (isSegment && !live[base]) {
+			if err := fsys.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			log.Printf("datastore: removed %s which is not listed in the manifest", name)
+		}
+	}
+	return nil
+}
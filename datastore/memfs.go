@@ -0,0 +1,368 @@
+package datastore
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS keeps files in memory, for tests and for databases that need not
+// outlive the process. Files behave as on a POSIX filesystem: a removed
+// file stays readable through the handles open on it, and hard links
+// share contents.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]time.Time
+}
+
+type memNode struct {
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  make(map[string]time.Time),
+	}
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// dirExists reports whether the directory exists. The caller must hold mu.
+func (m *MemFS) dirExists(name string) bool {
+	if name == "." || name == filepath.Dir(name) {
+		return true
+	}
+	_, ok := m.dirs[name]
+	return ok
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[name]; ok {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, fs.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, fs.ErrNotExist)
+	case !ok:
+		if !m.dirExists(filepath.Dir(name)) {
+			return nil, pathError("open", name, fs.ErrNotExist)
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[name] = node
+	}
+
+	f := &memFile{
+		node:     node,
+		name:     name,
+		readable: flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}
+	if flag&os.O_TRUNC != 0 && f.writable {
+		node.mu.Lock()
+		node.data, node.modTime = nil, time.Now()
+		node.mu.Unlock()
+	}
+	return f, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if node, ok := m.files[name]; ok {
+		return node.info(name), nil
+	}
+	if m.dirExists(name) {
+		return memFileInfo{name: filepath.Base(name), mode: fs.ModeDir | 0755, modTime: m.dirs[name]}, nil
+	}
+	return nil, pathError("stat", name, fs.ErrNotExist)
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirExists(name) {
+		return nil, pathError("readdir", name, fs.ErrNotExist)
+	}
+	var entries []os.DirEntry
+	for path, node := range m.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(node.info(path)))
+		}
+	}
+	for path, modTime := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: filepath.Base(path), mode: fs.ModeDir | 0755, modTime: modTime}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := name; !m.dirExists(dir); dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return pathError("mkdir", dir, fs.ErrExist)
+		}
+		m.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.files[oldname]
+	if !ok {
+		return pathError("rename", oldname, fs.ErrNotExist)
+	}
+	if !m.dirExists(filepath.Dir(newname)) {
+		return pathError("rename", newname, fs.ErrNotExist)
+	}
+	delete(m.files, oldname)
+	m.files[newname] = node
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.files[oldname]
+	if !ok {
+		return pathError("link", oldname, fs.ErrNotExist)
+	}
+	if _, ok := m.files[newname]; ok {
+		return pathError("link", newname, fs.ErrExist)
+	}
+	if !m.dirExists(filepath.Dir(newname)) {
+		return pathError("link", newname, fs.ErrNotExist)
+	}
+	m.files[newname] = node
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if strings.HasPrefix(path, prefix) {
+			return pathError("remove", name, fs.ErrExist)
+		}
+	}
+	for path := range m.dirs {
+		if strings.HasPrefix(path, prefix) {
+			return pathError("remove", name, fs.ErrExist)
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.files, path)
+		}
+	}
+	for path := range m.dirs {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.dirs, path)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) SyncDir(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirExists(name) {
+		return pathError("sync", name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (n *memNode) info(name string) memFileInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return memFileInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: 0600, modTime: n.modTime}
+}
+
+type memFile struct {
+	node     *memNode
+	name     string
+	pos      int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return pathError(op, f.name, fs.ErrClosed)
+	}
+	if !allowed {
+		return pathError(op, f.name, fs.ErrPermission)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.append {
+		f.pos = int64(len(f.node.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.node.mu.Lock()
+		offset += int64(len(f.node.data))
+		f.node.mu.Unlock()
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.writable); err != nil {
+		return err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", true)
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,248 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemStore keeps all records in memory and nothing on disk. It behaves
+// like a Db, including its errors, except that it cannot take snapshots
+// and loses everything when closed.
+type MemStore struct {
+	mu      sync.RWMutex
+	records map[string]entry
+	closed  bool
+	now     func() time.Time
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{records: make(map[string]entry), now: time.Now}
+}
+
+func (m *MemStore) Get(key string) (string, error) {
+	e, err := m.get(key)
+	if err != nil {
+		return "", err
+	}
+	if e.valueType != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return e.value, nil
+}
+
+func (m *MemStore) GetInt64(key string) (int64, error) {
+	e, err := m.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if e.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return e.int64(), nil
+}
+
+func (m *MemStore) get(key string) (entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return entry{}, errClosed
+	}
+	return m.getLocked(key)
+}
+
+func (m *MemStore) getLocked(key string) (entry, error) {
+	e, ok := m.records[key]
+	if !ok || e.expired(m.now()) {
+		return entry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func (m *MemStore) Put(key, value string) error {
+	return m.update(key, func(entry, error) (entry, error) {
+		return entry{key: key, value: value}, nil
+	})
+}
+
+func (m *MemStore) PutInt64(key string, value int64) error {
+	return m.update(key, func(entry, error) (entry, error) {
+		return int64Entry(key, value), nil
+	})
+}
+
+func (m *MemStore) Increment(key string, delta int64) (int64, error) {
+	var n int64
+	err := m.update(key, func(e entry, err error) (entry, error) {
+		var next entry
+		next, n, err = applyIncrement(key, e, err, delta)
+		return next, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (m *MemStore) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return m.update(key, func(entry, error) (entry, error) {
+		return entry{key: key, value: value, expiresAt: m.now().Add(ttl).UnixNano()}, nil
+	})
+}
+
+func (m *MemStore) CompareAndSwap(key, expected, value string) error {
+	return m.update(key, func(e entry, err error) (entry, error) {
+		if err := checkSwap(e, err, expected); err != nil {
+			return entry{}, err
+		}
+		return entry{key: key, value: value}, nil
+	})
+}
+
+func (m *MemStore) PutIfAbsent(key, value string) error {
+	return m.update(key, func(_ entry, err error) (entry, error) {
+		if err := checkAbsent(err); err != nil {
+			return entry{}, err
+		}
+		return entry{key: key, value: value}, nil
+	})
+}
+
+func (m *MemStore) Delete(key string) error {
+	return m.update(key, func(_ entry, err error) (entry, error) {
+		if err != nil {
+			return entry{}, err
+		}
+		return entry{key: key, tombstone: true}, nil
+	})
+}
+
+func (m *MemStore) update(key string, fn func(current entry, err error) (entry, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	e, err := fn(m.getLocked(key))
+	if err != nil {
+		return err
+	}
+	if err := e.validate(); err != nil {
+		return err
+	}
+	m.applyLocked(e)
+	return nil
+}
+
+func (m *MemStore) applyLocked(e entry) {
+	if e.tombstone {
+		delete(m.records, e.key)
+	} else {
+		m.records[e.key] = e
+	}
+}
+
+func (m *MemStore) WriteBatch(b *Batch) error {
+	for _, op := range b.ops {
+		if err := op.validate(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	for _, op := range b.ops {
+		m.applyLocked(op)
+	}
+	return nil
+}
+
+// Scan returns an iterator over the live keys in [start, end) as they are
+// when the scan starts.
+func (m *MemStore) Scan(start, end string) *Iterator {
+	return m.ScanLimit(start, end, 0)
+}
+
+// ScanLimit is like Scan but keeps only the first limit keys if limit is
+// positive.
+func (m *MemStore) ScanLimit(start, end string, limit int) *Iterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	it := &Iterator{}
+	if m.closed {
+		it.err = errClosed
+		return it
+	}
+	now := m.now()
+	for key, e := range m.records {
+		if key >= start && (end == "" || key < end) && !e.expired(now) {
+			it.items = append(it.items, scanItem{key: key, record: &e})
+		}
+	}
+	sort.Slice(it.items, func(i, j int) bool { return it.items[i].key < it.items[j].key })
+	if limit > 0 && len(it.items) > limit {
+		it.items = it.items[:limit]
+	}
+	return it
+}
+
+func (m *MemStore) ScanPrefix(prefix string) *Iterator {
+	return m.Scan(prefix, PrefixEnd(prefix))
+}
+
+// Stats counts the records as if they were written to a single segment
+// with nothing dead in it.
+func (m *MemStore) Stats() Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var stats Stats
+	now := m.now()
+	for _, e := range m.records {
+		if !e.expired(now) {
+			stats.LiveKeys++
+			stats.LiveBytes += int64(len(e.Encode()))
+		}
+	}
+	stats.TotalBytes = stats.LiveBytes
+	return stats
+}
+
+// Compact drops expired records.
+func (m *MemStore) Compact() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	now := m.now()
+	for key, e := range m.records {
+		if e.expired(now) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var total int64
+	for _, e := range m.records {
+		total += int64(len(e.Encode()))
+	}
+	return total, nil
+}
+
+func (m *MemStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.records = nil
+	return nil
+}
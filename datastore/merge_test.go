@@ -0,0 +1,283 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func checkFiles(t *testing.T, dir string) {
+	t.Helper()
+	checkFilesOn(t, OSFS, dir)
+}
+
+func checkFilesOn(t *testing.T, fsys FS, dir string) {
+	t.Helper()
+	names, err := readManifest(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := map[string]bool{manifestFileName: true}
+	for _, name := range names {
+		allowed[name] = true
+		allowed[name+hintSuffix] = true
+		allowed[name+bloomSuffix] = true
+	}
+
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !allowed[file.Name()] && !strings.HasPrefix(file.Name(), indexDirPrefix) {
+			t.Errorf("Unexpected file %s, manifest lists %v", file.Name(), names)
+		}
+	}
+}
+
+func TestMergeInterrupted(t *testing.T) {
+	for _, step := range []string{"copy", "sync", "rename", "install", "relocate", "manifest"} {
+		t.Run(step, func(t *testing.T) {
+			tmp := t.TempDir()
+			expected := fillSegments(t, tmp, 30)
+
+			db, err := OpenWithMaxSize(tmp, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.interrupt = func(s string) bool { return s == step }
+			if err := db.mergeSegments(); err != errMergeInterrupted {
+				t.Fatalf("Expected the merge to be interrupted, got %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenWithMaxSize(tmp, 100)
+			if err != nil {
+				t.Fatalf("Reopen after merge stopped at %s failed: %s", step, err)
+			}
+			defer db.Close()
+			checkContents(t, db, expected)
+			checkFiles(t, tmp)
+
+			if err := db.mergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			checkContents(t, db, expected)
+			checkFiles(t, tmp)
+		})
+	}
+}
+
+func TestWritesDuringMerge(t *testing.T) {
+	tmp := t.TempDir()
+	fillSegments(t, tmp, 30)
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	paused, resume := make(chan struct{}), make(chan struct{})
+	db.interrupt = func(step string) bool {
+		if step == "sync" {
+			close(paused)
+			<-resume
+		}
+		return false
+	}
+	done := make(chan error)
+	go func() { done <- db.mergeSegments() }()
+	<-paused
+
+	if err := db.Put("key0", "during-merge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil && err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if err := db.Put("new", "value"); err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		if value, err := db.Get("key0"); err != nil || value != "during-merge" {
+			t.Errorf("Expected write made during merge to win, got %q (%v)", value, err)
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected key deleted during merge to stay deleted, got %v", err)
+		}
+		if value, err := db.Get("new"); err != nil || value != "value" {
+			t.Errorf("Expected 'value', got %q (%v)", value, err)
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	checkFiles(t, tmp)
+}
+
+func TestWritesDuringRelocation(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithMaxSize(4096), WithIndex(IndexDisk), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	const n = 3 * relocateChunk
+	for i := 0; i < n; i++ {
+		if err := db.Put(fmt.Sprintf("key%05d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The merge stops after moving the first chunk of keys, which must not
+	// keep reads and writes waiting.
+	paused, resume := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	db.interrupt = func(step string) bool {
+		if step == "relocate" {
+			once.Do(func() {
+				close(paused)
+				<-resume
+			})
+		}
+		return false
+	}
+	done := make(chan error)
+	go func() { done <- db.mergeSegments() }()
+	<-paused
+
+	for i := 0; i < n; i += 100 {
+		key := fmt.Sprintf("key%05d", i)
+		if v, err := db.Get(key); err != nil || v != "old" {
+			t.Fatalf("Get(%s) = %q (%v) during the merge", key, v, err)
+		}
+		if err := db.Put(key, "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key00001"); err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			key, want := fmt.Sprintf("key%05d", i), "old"
+			if i%100 == 0 {
+				want = "new"
+			}
+			v, err := db.Get(key)
+			if i == 1 {
+				if err != ErrNotFound {
+					t.Errorf("Expected %s deleted during the merge to stay deleted, got %v", key, err)
+				}
+			} else if err != nil || v != want {
+				t.Fatalf("Get(%s) = %q (%v), wanted %q", key, v, err, want)
+			}
+		}
+	}
+	check()
+	if s := db.Stats(); s.LiveKeys != n-1 {
+		t.Errorf("Expected %d live keys, got %d", n-1, s.LiveKeys)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp, WithMaxSize(4096), WithIndex(IndexDisk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	checkFiles(t, tmp)
+}
+
+func TestGetDuringMerge(t *testing.T) {
+	db, err := OpenWithMaxSize(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				if _, err := db.Get(fmt.Sprintf("key%d", i%10)); err != nil {
+					t.Errorf("Get failed during merge: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%20 == 0 {
+			if err := db.mergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestRetiredSegmentKeptWhileRead(t *testing.T) {
+	tmp := t.TempDir()
+	fillSegments(t, tmp, 30)
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	seg := db.segments[0]
+	seg.acquire()
+	if err := db.mergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(seg.filePath); err != nil {
+		t.Errorf("Segment removed while still referenced: %s", err)
+	}
+	seg.release()
+	if _, err := os.Stat(seg.filePath); !os.IsNotExist(err) {
+		t.Errorf("Expected retired segment to be removed after the last reference, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, mergeTempName)); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be gone after merge, got %v", mergeTempName, err)
+	}
+}
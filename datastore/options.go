@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing written data to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncAlways fsyncs the active segment after every write.
+	SyncAlways
+	// SyncBatch fsyncs once for all writes collected from concurrent callers.
+	SyncBatch
+	// SyncInterval fsyncs the active segment periodically in the background.
+	SyncInterval
+)
+
+const defaultSyncInterval = 100 * time.Millisecond
+
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "never":
+		return SyncNever, nil
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "interval":
+		return SyncInterval, nil
+	}
+	return SyncNever, fmt.Errorf("unknown sync policy %q", name)
+}
+
+// IndexKind selects how a Db finds the records of its keys.
+type IndexKind int
+
+const (
+	// IndexMemory keeps every key in memory.
+	IndexMemory IndexKind = iota
+	// IndexDisk keeps only a sparse index in memory and the rest in sorted
+	// files on disk, so that the index takes bounded memory however many
+	// keys there are, at the cost of slower lookups. Scans and Dump still
+	// hold the keys they return in memory; ScanLimit bounds how many.
+	IndexDisk
+)
+
+func ParseIndexKind(name string) (IndexKind, error) {
+	switch name {
+	case "memory":
+		return IndexMemory, nil
+	case "disk":
+		return IndexDisk, nil
+	}
+	return IndexMemory, fmt.Errorf("unknown index kind %q", name)
+}
+
+type options struct {
+	maxSize        int64
+	syncPolicy     SyncPolicy
+	syncInterval   time.Duration
+	compaction     CompactionPolicy
+	replicationLog int
+	fs             FS
+	cacheSize      int64
+	bloomRate      float64
+	compressAbove  int
+	index          IndexKind
+	indexBuffer    int
+}
+
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		maxSize:      defaultMaxSize,
+		syncPolicy:   SyncNever,
+		syncInterval: defaultSyncInterval,
+		compaction:   DefaultCompactionPolicy,
+		fs:           OSFS,
+		indexBuffer:  defaultIndexBuffer,
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func WithMaxSize(maxSize int64) Option {
+	return func(o *options) {
+		o.maxSize = maxSize
+	}
+}
+
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval selects SyncInterval with the given period.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.syncPolicy = SyncInterval
+		o.syncInterval = interval
+	}
+}
+
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(o *options) {
+		o.compaction = policy
+	}
+}
+
+// WithReplicationLog keeps the last n written records in memory for
+// ReadLog. Without it the log is off, as keeping it copies every record,
+// and replicas always start over from Dump.
+func WithReplicationLog(n int) Option {
+	return func(o *options) {
+		o.replicationLog = n
+	}
+}
+
+// WithFS keeps the database on fsys instead of the OS filesystem.
+func WithFS(fsys FS) Option {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// WithCache keeps up to maxBytes of recently read values in memory, so
+// that reading them again skips the segment files. Zero disables it.
+func WithCache(maxBytes int64) Option {
+	return func(o *options) {
+		o.cacheSize = maxBytes
+	}
+}
+
+// WithBloomFilter keeps a Bloom filter of the keys in every segment, sized
+// for the given false positive rate, so that looking up missing keys rarely
+// reaches the index or the segment files. Zero disables the filters.
+func WithBloomFilter(fpRate float64) Option {
+	return func(o *options) {
+		o.bloomRate = fpRate
+	}
+}
+
+// WithCompression stores string values of at least threshold bytes
+// compressed with flate, if that makes them shorter. Zero disables
+// compression; values written compressed are read either way.
+func WithCompression(threshold int) Option {
+	return func(o *options) {
+		o.compressAbove = threshold
+	}
+}
+
+func WithIndex(kind IndexKind) Option {
+	return func(o *options) {
+		o.index = kind
+	}
+}
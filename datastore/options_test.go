@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSyncPolicies(t *testing.T) {
+	policies := map[string][]Option{
+		"never":    {WithSyncPolicy(SyncNever)},
+		"always":   {WithSyncPolicy(SyncAlways)},
+		"batch":    {WithSyncPolicy(SyncBatch)},
+		"interval": {WithSyncInterval(time.Millisecond)},
+	}
+
+	for name, opts := range policies {
+		t.Run(name, func(t *testing.T) {
+			tmp := t.TempDir()
+			opts := append(opts, WithMaxSize(200))
+
+			db, err := Open(tmp, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = Open(tmp, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 50; i++ {
+				value, err := db.Get(fmt.Sprintf("key%d", i))
+				if err != nil || value != fmt.Sprintf("value%d", i) {
+					t.Errorf("Get(key%d) = %q (%v)", i, value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	db, err := Open(t.TempDir(), WithSyncInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		db.writeMutex.Lock()
+		dirty := db.dirty
+		db.writeMutex.Unlock()
+		if !dirty {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Active segment was not synced in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCollectWrites(t *testing.T) {
+	db, err := Open(t.TempDir(), WithSyncPolicy(SyncBatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Hold the writer so that concurrent callers queue up behind it.
+	db.writeMutex.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	db.writeMutex.Unlock()
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Get(key%d): %s", i, err)
+		}
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for name, expected := range map[string]SyncPolicy{
+		"never":    SyncNever,
+		"always":   SyncAlways,
+		"batch":    SyncBatch,
+		"interval": SyncInterval,
+	} {
+		policy, err := ParseSyncPolicy(name)
+		if err != nil || policy != expected {
+			t.Errorf("ParseSyncPolicy(%q) = %v (%v), wanted %v", name, policy, err, expected)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("Expected an error for unknown policy")
+	}
+}
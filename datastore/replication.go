@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// applyChunk is how many records Apply writes at once at most, unless a
+// single batch is longer.
+const applyChunk = 1000
+
+var ErrLogTruncated = fmt.Errorf("replication log does not reach back to the position")
+
+// LogPosition is a point in the replication log of a Db: the number of
+// records written in the current epoch. The epoch changes whenever the
+// database is opened or restored, as the log starts over then.
+type LogPosition struct {
+	Epoch string
+	Seq   uint64
+}
+
+type logRecord struct {
+	seq       uint64
+	data      []byte
+	continued bool
+}
+
+func newEpoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logLocked numbers the records just written from buf, starting at the
+// segment offset base, and keeps them for ReadLog. The caller must hold mu.
+func (db *Db) logLocked(entries []entry, infos []recordInfo, buf []byte, base int64) {
+	for i, info := range infos {
+		db.seq++
+		if db.replLogSize == 0 {
+			continue
+		}
+		start := info.offset - base
+		db.replLog = append(db.replLog, logRecord{
+			seq:       db.seq,
+			data:      append([]byte(nil), buf[start:start+info.size]...),
+			continued: entries[i].continued,
+		})
+	}
+	// The log is trimmed in bulk so that appending stays cheap.
+	if db.replLogSize > 0 && len(db.replLog) >= 2*db.replLogSize {
+		db.replLog = append([]logRecord(nil), db.replLog[len(db.replLog)-db.replLogSize:]...)
+	}
+}
+
+func (db *Db) Position() LogPosition {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return LogPosition{Epoch: db.epoch, Seq: db.seq}
+}
+
+// ReadLog returns the encoded records written after pos and the position
+// they lead to. It returns at least max records if there are as many, and
+// more only to finish a batch. If the log no longer holds the records right
+// after pos it fails with ErrLogTruncated, and the reader has to start over
+// from Dump.
+func (db *Db) ReadLog(pos LogPosition, max int) ([]byte, LogPosition, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if pos.Epoch != db.epoch || pos.Seq > db.seq {
+		return nil, pos, ErrLogTruncated
+	}
+	if pos.Seq == db.seq {
+		return nil, pos, nil
+	}
+	if len(db.replLog) == 0 || pos.Seq+1 < db.replLog[0].seq {
+		return nil, pos, ErrLogTruncated
+	}
+
+	var data []byte
+	n := 0
+	for _, r := range db.replLog[pos.Seq+1-db.replLog[0].seq:] {
+		data = append(data, r.data...)
+		pos.Seq = r.seq
+		n++
+		if n >= max && !r.continued {
+			break
+		}
+	}
+	return data, pos, nil
+}
+
+// Dump returns an iterator over all live keys together with the log
+// position it reflects, so that a replica loaded from it goes on with
+// ReadLog from there.
+func (db *Db) Dump() (*Iterator, LogPosition) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.scanLocked("", "", 0), LogPosition{Epoch: db.epoch, Seq: db.seq}
+}
+
+// Record returns the current record encoded the same way as in ReadLog.
+func (it *Iterator) Record() []byte {
+	e := it.value
+	e.key, e.continued = it.key, false
+	return e.Encode()
+}
+
+// Apply writes the encoded records read from ReadLog or Dump of another
+// Db. Each batch among them is applied atomically.
+func (db *Db) Apply(r io.Reader) error {
+	in := bufio.NewReader(r)
+	var b Batch
+	for {
+		var e entry
+		if _, err := e.DecodeFromReader(in); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		b.ops = append(b.ops, e)
+		if !e.continued && len(b.ops) >= applyChunk {
+			if err := db.WriteBatch(&b); err != nil {
+				return err
+			}
+			b.ops = nil
+		}
+	}
+	if len(b.ops) > 0 && b.ops[len(b.ops)-1].continued {
+		return fmt.Errorf("%w: last batch is cut off", ErrCorrupted)
+	}
+	return db.WriteBatch(&b)
+}
+
+// RestoreDump replaces the contents of the database with the records of a
+// Dump. They are loaded into a scratch database next to dir first, which
+// then is restored as a snapshot.
+func (db *Db) RestoreDump(r io.Reader) error {
+	tmp := db.dir + ".dump-" + newEpoch()
+	defer db.fs.RemoveAll(tmp)
+
+	scratch, err := Open(tmp, WithFS(db.fs), WithMaxSize(db.maxSize), WithCompactionPolicy(CompactionPolicy{}), WithReplicationLog(0), WithIndex(db.indexKind))
+	if err != nil {
+		return err
+	}
+	err = scratch.Apply(r)
+	if cerr := scratch.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return db.Restore(tmp)
+}
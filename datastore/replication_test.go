@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// catchUp applies the leader's log to the follower until it has all of it.
+func catchUp(t *testing.T, leader, follower *Db, pos LogPosition) LogPosition {
+	t.Helper()
+	for {
+		data, next, err := leader.ReadLog(pos, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == pos {
+			return pos
+		}
+		if err := follower.Apply(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		pos = next
+	}
+}
+
+func TestReplicationLog(t *testing.T) {
+	leader, err := Open(t.TempDir(), WithMaxSize(200), WithReplicationLog(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	pos := LogPosition{Epoch: leader.Position().Epoch}
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i%7), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Increment("counter", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.PutWithTTL("temp", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	for i := 0; i < 5; i++ {
+		b.Put(fmt.Sprintf("batch%d", i), "value")
+	}
+	if err := leader.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	pos = catchUp(t, leader, follower, pos)
+	if pos != leader.Position() {
+		t.Errorf("Expected the follower at %v, got %v", leader.Position(), pos)
+	}
+
+	for _, key := range []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "temp", "batch0", "batch4"} {
+		want, wantErr := leader.Get(key)
+		if got, err := follower.Get(key); got != want || err != wantErr {
+			t.Errorf("Get(%q) = %q (%v) on the follower, %q (%v) on the leader", key, got, err, want, wantErr)
+		}
+	}
+	if n, err := follower.GetInt64("counter"); err != nil || n != 5 {
+		t.Errorf("Expected counter 5, got %d (%v)", n, err)
+	}
+}
+
+func TestReplicationFromDump(t *testing.T) {
+	leader, err := Open(t.TempDir(), WithMaxSize(200), WithReplicationLog(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	if err := follower.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := leader.ReadLog(LogPosition{Epoch: leader.Position().Epoch}, 10); err != ErrLogTruncated {
+		t.Fatalf("Expected ErrLogTruncated, got %v", err)
+	}
+
+	it, pos := leader.Dump()
+	var dump bytes.Buffer
+	for it.Next() {
+		dump.Write(it.Record())
+	}
+	it.Close()
+	if err := follower.RestoreDump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Get("stale"); err != ErrNotFound {
+		t.Errorf("Expected keys missing from the dump to be gone, got %v", err)
+	}
+
+	if err := leader.Put("key0", "later"); err != nil {
+		t.Fatal(err)
+	}
+	catchUp(t, leader, follower, pos)
+	for i := 0; i < 20; i++ {
+		want := "value"
+		if i == 0 {
+			want = "later"
+		}
+		if value, err := follower.Get(fmt.Sprintf("key%d", i)); err != nil || value != want {
+			t.Errorf("Get(key%d) = %q (%v), wanted %q", i, value, err, want)
+		}
+	}
+}
+
+func TestReplicationEpoch(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	pos := db.Position()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Position().Epoch == pos.Epoch {
+		t.Errorf("Expected a new epoch after reopening")
+	}
+	if _, _, err := db.ReadLog(pos, 10); err != ErrLogTruncated {
+		t.Errorf("Expected ErrLogTruncated for a position from before reopening, got %v", err)
+	}
+}
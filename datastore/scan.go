@@ -0,0 +1,175 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Iterator walks a snapshot of keys taken when the scan started. Writes
+// and merges made afterwards do not change what it returns: it keeps the
+// segment files it reads from open, so they stay readable even if a merge
+// removes them. Close must be called once the iterator is not needed.
+type Iterator struct {
+	items []scanItem
+	files []*snapshotFile
+	pos   int
+	key   string
+	value entry
+	err   error
+}
+
+type scanItem struct {
+	key  string
+	loc  segmentLocation
+	file *snapshotFile
+	// record is set when the record was read up front.
+	record *entry
+}
+
+type snapshotFile struct {
+	file   File
+	format byte
+}
+
+func (db *Db) Scan(start, end string) *Iterator {
+	return db.ScanLimit(start, end, 0)
+}
+
+// ScanLimit is like Scan but stops after limit keys if limit is positive,
+// so that only as many keys as are needed are held by the iterator.
+func (db *Db) ScanLimit(start, end string, limit int) *Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.scanLocked(start, end, limit)
+}
+
+func (db *Db) scanLocked(start, end string, limit int) *Iterator {
+	it := &Iterator{}
+
+	files := make(map[int]*snapshotFile)
+	now := db.now()
+	db.index.Ascend(start, end, func(key string, loc segmentLocation) bool {
+		if loc.expired(now) {
+			return true
+		}
+		it.items = append(it.items, scanItem{key: key, loc: loc})
+		files[loc.segID] = nil
+		return len(it.items) != limit
+	})
+	if err := db.index.Err(); err != nil {
+		it.err = err
+		return it
+	}
+
+	for _, seg := range db.segments {
+		if _, ok := files[seg.id]; !ok {
+			continue
+		}
+		f, err := openFile(db.fs, seg.filePath)
+		if err != nil {
+			it.err = err
+			it.Close()
+			return it
+		}
+		files[seg.id] = &snapshotFile{file: f, format: seg.format}
+		it.files = append(it.files, files[seg.id])
+	}
+	for i := range it.items {
+		it.items[i].file = files[it.items[i].loc.segID]
+	}
+
+	return it
+}
+
+func (db *Db) ScanPrefix(prefix string) *Iterator {
+	return db.Scan(prefix, PrefixEnd(prefix))
+}
+
+// PrefixEnd returns the smallest key greater than every key that starts
+// with prefix, or "" if there is none. Scan(prefix, PrefixEnd(prefix)) is
+// the same as ScanPrefix(prefix).
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.items) {
+		return false
+	}
+
+	item := it.items[it.pos]
+	it.pos++
+	if item.record != nil {
+		it.key, it.value = item.key, *item.record
+		return true
+	}
+
+	sf := item.file
+	if sf == nil {
+		it.err = fmt.Errorf("segment %d not found", item.loc.segID)
+		return false
+	}
+
+	var record entry
+	in := bufio.NewReader(io.NewSectionReader(sf.file, item.loc.offset, math.MaxInt64-item.loc.offset))
+	_, err := record.decodeFromReader(in, sf.format)
+	if err == nil {
+		err = record.decompress()
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.key, it.value = item.key, record
+	return true
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the current value if it is a string, or "" otherwise.
+func (it *Iterator) Value() string {
+	if it.value.valueType != TypeString {
+		return ""
+	}
+	return it.value.value
+}
+
+// Int64 returns the current value if it is an int64, or 0 otherwise.
+func (it *Iterator) Int64() int64 {
+	if it.value.valueType != TypeInt64 {
+		return 0
+	}
+	return it.value.int64()
+}
+
+func (it *Iterator) Type() ValueType {
+	return it.value.valueType
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() error {
+	var firstErr error
+	for _, sf := range it.files {
+		if err := sf.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.files = nil
+	it.pos = len(it.items)
+	return firstErr
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func collect(t *testing.T, it *Iterator) [][2]string {
+	t.Helper()
+	defer it.Close()
+	var res [][2]string
+	for it.Next() {
+		res = append(res, [2]string{it.Key(), it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestScan(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"b", "a", "user:2", "user:1", "user:10", "c", "user;"} {
+		if err := db.Put(key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	res := collect(t, db.Scan("a", "user:"))
+	if fmt.Sprint(res) != "[[a v-a] [b v-b]]" {
+		t.Errorf("Unexpected range scan result %v", res)
+	}
+
+	res = collect(t, db.ScanPrefix("user:"))
+	if fmt.Sprint(res) != "[[user:1 v-user:1] [user:10 v-user:10] [user:2 v-user:2]]" {
+		t.Errorf("Unexpected prefix scan result %v", res)
+	}
+
+	res = collect(t, db.Scan("", ""))
+	if len(res) != 6 {
+		t.Errorf("Expected 6 keys in full scan, got %v", res)
+	}
+}
+
+func TestScanSnapshot(t *testing.T) {
+	db, err := OpenWithMaxSize(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := db.ScanPrefix("key")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key99", "new"); err != nil {
+		t.Fatal(err)
+	}
+	db.mergeSegments()
+
+	res := collect(t, it)
+	if len(res) != 10 {
+		t.Fatalf("Expected 10 keys in snapshot, got %d", len(res))
+	}
+	for _, kv := range res {
+		if kv[1] != "old" {
+			t.Errorf("Snapshot returned %s=%s, wanted the value at scan start", kv[0], kv[1])
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shardsFileName records the shard count of a sharded database, since
+// keys would end up in other shards under a different count.
+const shardsFileName = "SHARDS"
+
+// ShardedDb spreads keys by hash over independent Db instances, each with
+// its own directory, writer and merges. Every operation on a single key
+// behaves as on a Db. A batch is only atomic within one shard, and scans
+// and snapshots are consistent per shard.
+type ShardedDb struct {
+	shards []*Db
+}
+
+// OpenSharded opens a database of n shards in dir. A single shard lives in
+// dir itself, so that it reads databases created with Open; more shards
+// live in the subdirectories shard-0 to shard-(n-1).
+func OpenSharded(dir string, n int, opts ...Option) (*ShardedDb, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("shard count must be positive, got %d", n)
+	}
+	if err := checkShardCount(newOptions(opts).fs, dir, n); err != nil {
+		return nil, err
+	}
+
+	sdb := &ShardedDb{}
+	for i := 0; i < n; i++ {
+		shardDir := dir
+		if n > 1 {
+			shardDir = filepath.Join(dir, fmt.Sprintf("shard-%d", i))
+		}
+		db, err := Open(shardDir, opts...)
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	return sdb, nil
+}
+
+func checkShardCount(fsys FS, dir string, n int) error {
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, shardsFileName)
+	data, err := readFile(fsys, path)
+	if os.IsNotExist(err) {
+		if n == 1 {
+			return nil
+		}
+		if _, err := fsys.Stat(filepath.Join(dir, manifestFileName)); err == nil {
+			return fmt.Errorf("%s holds an unsharded database", dir)
+		}
+		return writeShardCount(fsys, dir, n)
+	} else if err != nil {
+		return err
+	}
+
+	stored, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("bad %s: %w", path, err)
+	}
+	if stored != n {
+		return fmt.Errorf("%s holds %d shards, not %d", dir, stored, n)
+	}
+	return nil
+}
+
+func writeShardCount(fsys FS, dir string, n int) error {
+	if err := writeFile(fsys, filepath.Join(dir, shardsFileName), []byte(strconv.Itoa(n)+"\n"), true); err != nil {
+		return err
+	}
+	return fsys.SyncDir(dir)
+}
+
+func (sdb *ShardedDb) Shards() int {
+	return len(sdb.shards)
+}
+
+// Shard returns the i-th shard.
+func (sdb *ShardedDb) Shard(i int) *Db {
+	return sdb.shards[i]
+}
+
+func (sdb *ShardedDb) shardFor(key string) *Db {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return sdb.shards[h.Sum32()%uint32(len(sdb.shards))]
+}
+
+func (sdb *ShardedDb) Get(key string) (string, error) {
+	return sdb.shardFor(key).Get(key)
+}
+
+func (sdb *ShardedDb) GetInt64(key string) (int64, error) {
+	return sdb.shardFor(key).GetInt64(key)
+}
+
+func (sdb *ShardedDb) Put(key, value string) error {
+	return sdb.shardFor(key).Put(key, value)
+}
+
+func (sdb *ShardedDb) PutInt64(key string, value int64) error {
+	return sdb.shardFor(key).PutInt64(key, value)
+}
+
+func (sdb *ShardedDb) Increment(key string, delta int64) (int64, error) {
+	return sdb.shardFor(key).Increment(key, delta)
+}
+
+func (sdb *ShardedDb) PutWithTTL(key, value string, ttl time.Duration) error {
+	return sdb.shardFor(key).PutWithTTL(key, value, ttl)
+}
+
+func (sdb *ShardedDb) CompareAndSwap(key, expected, value string) error {
+	return sdb.shardFor(key).CompareAndSwap(key, expected, value)
+}
+
+func (sdb *ShardedDb) PutIfAbsent(key, value string) error {
+	return sdb.shardFor(key).PutIfAbsent(key, value)
+}
+
+func (sdb *ShardedDb) Delete(key string) error {
+	return sdb.shardFor(key).Delete(key)
+}
+
+// WriteBatch splits the batch by shard and writes the parts concurrently.
+// Each part is applied atomically, but the batch as a whole is not.
+func (sdb *ShardedDb) WriteBatch(b *Batch) error {
+	if len(sdb.shards) == 1 {
+		return sdb.shards[0].WriteBatch(b)
+	}
+	parts := make(map[*Db]*Batch)
+	for _, op := range b.ops {
+		db := sdb.shardFor(op.key)
+		if parts[db] == nil {
+			parts[db] = &Batch{}
+		}
+		parts[db].ops = append(parts[db].ops, op)
+	}
+	return sdb.each(func(db *Db) error {
+		if part := parts[db]; part != nil {
+			return db.WriteBatch(part)
+		}
+		return nil
+	})
+}
+
+// each runs fn on all shards in parallel and joins the errors.
+func (sdb *ShardedDb) each(fn func(db *Db) error) error {
+	errs := make([]error, len(sdb.shards))
+	var wg sync.WaitGroup
+	for i, db := range sdb.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(db)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Compact merges the sealed segments of all shards in parallel.
+func (sdb *ShardedDb) Compact() error {
+	return sdb.each((*Db).Compact)
+}
+
+// Scan returns the keys of all shards in order.
+func (sdb *ShardedDb) Scan(start, end string) *Iterator {
+	return sdb.ScanLimit(start, end, 0)
+}
+
+// ScanLimit asks every shard for up to limit keys, as any of them may hold
+// all of the first ones, and keeps the first limit keys of all of them.
+func (sdb *ShardedDb) ScanLimit(start, end string, limit int) *Iterator {
+	if len(sdb.shards) == 1 {
+		return sdb.shards[0].ScanLimit(start, end, limit)
+	}
+	it := &Iterator{}
+	for _, db := range sdb.shards {
+		part := db.ScanLimit(start, end, limit)
+		it.items = append(it.items, part.items...)
+		it.files = append(it.files, part.files...)
+		if part.err != nil && it.err == nil {
+			it.err = part.err
+		}
+	}
+	if it.err != nil {
+		it.Close()
+		return it
+	}
+	sort.Slice(it.items, func(i, j int) bool { return it.items[i].key < it.items[j].key })
+	if limit > 0 && len(it.items) > limit {
+		it.items = it.items[:limit]
+	}
+	return it
+}
+
+func (sdb *ShardedDb) ScanPrefix(prefix string) *Iterator {
+	return sdb.Scan(prefix, PrefixEnd(prefix))
+}
+
+// Stats adds up the stats of all shards. Segment names are prefixed with
+// the shard directory if there is more than one.
+func (sdb *ShardedDb) Stats() Stats {
+	if len(sdb.shards) == 1 {
+		return sdb.shards[0].Stats()
+	}
+	var total Stats
+	for i, db := range sdb.shards {
+		s := db.Stats()
+		total.LiveKeys += s.LiveKeys
+		total.TotalBytes += s.TotalBytes
+		total.LiveBytes += s.LiveBytes
+		total.DeadBytes += s.DeadBytes
+		for _, seg := range s.Segments {
+			seg.Name = fmt.Sprintf("shard-%d/%s", i, seg.Name)
+			total.Segments = append(total.Segments, seg)
+		}
+		total.MergeCount += s.MergeCount
+		total.CacheHits += s.CacheHits
+		total.CacheMisses += s.CacheMisses
+		total.CacheBytes += s.CacheBytes
+		total.BloomNegatives += s.BloomNegatives
+		total.BloomFalsePositives += s.BloomFalsePositives
+		total.BloomBytes += s.BloomBytes
+		total.UncompressedBytes += s.UncompressedBytes
+		total.CompressedBytes += s.CompressedBytes
+		if s.LastMerge.After(total.LastMerge) {
+			total.LastMerge, total.LastMergeDuration = s.LastMerge, s.LastMergeDuration
+		}
+	}
+	if total.TotalBytes > 0 {
+		total.GarbageRatio = float64(total.DeadBytes) / float64(total.TotalBytes)
+	}
+	total.setBloomRate()
+	total.setCompressionRatio()
+	return total
+}
+
+// Snapshot writes a snapshot of every shard to the matching subdirectory
+// of dir, laid out like the database so that OpenSharded reads it. A
+// single shard is written to dir itself. Either way the snapshot is
+// complete once dir holds a MANIFEST or SHARDS file.
+func (sdb *ShardedDb) Snapshot(dir string) error {
+	if len(sdb.shards) == 1 {
+		return sdb.shards[0].Snapshot(dir)
+	}
+	fsys := sdb.shards[0].fs
+	if files, err := fsys.ReadDir(dir); err == nil && len(files) > 0 {
+		return fmt.Errorf("snapshot directory %s is not empty", dir)
+	}
+	for i, db := range sdb.shards {
+		if err := db.Snapshot(filepath.Join(dir, fmt.Sprintf("shard-%d", i))); err != nil {
+			return err
+		}
+	}
+	// The shard count goes last and marks the snapshot complete.
+	return writeShardCount(fsys, dir, len(sdb.shards))
+}
+
+func (sdb *ShardedDb) Size() (int64, error) {
+	var total int64
+	for _, db := range sdb.shards {
+		size, err := db.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func (sdb *ShardedDb) Close() error {
+	var errs []error
+	for _, db := range sdb.shards {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedDb(t *testing.T) {
+	tmp := t.TempDir()
+	sdb, err := OpenSharded(tmp, 4, WithMaxSize(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sdb.Close() }()
+
+	for i := 0; i < 50; i++ {
+		if err := sdb.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sdb.Increment("counter", 3); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Delete("key00")
+	b.Delete("key01")
+	if err := sdb.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	used := 0
+	for i := 0; i < sdb.Shards(); i++ {
+		if sdb.Shard(i).Stats().LiveKeys > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("Expected keys spread over the shards, %d of them used", used)
+	}
+	if err := sdb.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sdb.Stats(); stats.LiveKeys != 49 {
+		t.Errorf("Expected 49 live keys over all shards, got %d", stats.LiveKeys)
+	}
+
+	it := sdb.ScanPrefix("key")
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Close()
+	if len(keys) != 48 || keys[0] != "key02" || keys[47] != "key49" {
+		t.Errorf("Expected key02..key49 in order, got %v", keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Errorf("Keys out of order: %s before %s", keys[i-1], keys[i])
+		}
+	}
+
+	it = sdb.ScanLimit("key1", "", 5)
+	keys = nil
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[key10 key11 key12 key13 key14]" {
+		t.Errorf("Expected the first 5 keys from key10, got %v", keys)
+	}
+
+	snapDir := t.TempDir()
+	if err := sdb.Snapshot(snapDir); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := OpenSharded(snapDir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := snap.Get("key42"); err != nil || value != "value42" {
+		t.Errorf("Expected 'value42' in the snapshot, got %q (%v)", value, err)
+	}
+	snap.Close()
+
+	if err := sdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSharded(tmp, 2); err == nil {
+		t.Errorf("Expected opening with another shard count to fail")
+	}
+
+	sdb, err = OpenSharded(tmp, 4, WithMaxSize(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := sdb.Get("key42"); err != nil || value != "value42" {
+		t.Errorf("Expected 'value42' after reopening, got %q (%v)", value, err)
+	}
+	if n, err := sdb.GetInt64("counter"); err != nil || n != 3 {
+		t.Errorf("Expected counter 3 after reopening, got %d (%v)", n, err)
+	}
+}
+
+func TestShardedDbSingleShard(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenSharded(tmp, 2); err == nil {
+		t.Errorf("Expected an unsharded database not to open with 2 shards")
+	}
+	sdb, err := OpenSharded(tmp, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	if value, err := sdb.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected a single shard to read the database, got %q (%v)", value, err)
+	}
+}
+
+func BenchmarkShardedPut(b *testing.B) {
+	for _, policy := range []string{"never", "batch"} {
+		p, _ := ParseSyncPolicy(policy)
+		for _, shards := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/shards=%d", policy, shards), func(b *testing.B) {
+				sdb, err := OpenSharded(b.TempDir(), shards, WithSyncPolicy(p))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer sdb.Close()
+
+				var counter atomic.Int64
+				value := strings.Repeat("v", 100)
+
+				b.SetParallelism(8)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						key := fmt.Sprintf("key%d", counter.Add(1)%1000)
+						if err := sdb.Put(key, value); err != nil {
+							b.Error(err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
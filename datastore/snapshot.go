@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var errClosed = fmt.Errorf("database is closed")
+
+// Snapshot writes a consistent copy of the database to dir, which must be
+// empty or not exist yet. Sealed segments are hard-linked when possible and
+// the active segment is copied up to its size at the start, so writes go
+// on while the snapshot is taken.
+func (db *Db) Snapshot(dir string) error {
+	if files, err := db.fs.ReadDir(dir); err == nil && len(files) > 0 {
+		return fmt.Errorf("snapshot directory %s is not empty", dir)
+	}
+	if err := db.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Writes are applied in whole groups under writeMutex, so the active
+	// segment never ends in the middle of a batch here.
+	db.writeMutex.Lock()
+	if db.out == nil {
+		db.writeMutex.Unlock()
+		return errClosed
+	}
+	segments := append([]*segment(nil), db.segments...)
+	for _, seg := range segments {
+		seg.acquire()
+	}
+	activeSize := db.out.size
+	db.writeMutex.Unlock()
+
+	defer func() {
+		for _, seg := range segments {
+			seg.release()
+		}
+	}()
+
+	for i, seg := range segments {
+		dst := filepath.Join(dir, filepath.Base(seg.filePath))
+		if i == len(segments)-1 {
+			if err := copyFile(db.fs, seg.filePath, dst, activeSize); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := linkOrCopy(db.fs, seg.filePath, dst); err != nil {
+			return err
+		}
+		// Hints and filters only speed up opening the snapshot.
+		linkOrCopy(db.fs, hintPath(seg.filePath), hintPath(dst))
+		linkOrCopy(db.fs, bloomPath(seg.filePath), bloomPath(dst))
+	}
+	return writeManifest(db.fs, dir, segments)
+}
+
+// Restore replaces the contents of the database with a snapshot written by
+// Snapshot. Writes and merges wait until it is done.
+func (db *Db) Restore(snapshotDir string) error {
+	names, err := readManifest(db.fs, snapshotDir)
+	if err != nil {
+		return fmt.Errorf("cannot read snapshot: %w", err)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("snapshot %s has no segments", snapshotDir)
+	}
+
+	db.mergeMutex.Lock()
+	defer db.mergeMutex.Unlock()
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+	if db.out == nil {
+		return errClosed
+	}
+
+	// The snapshot is loaded into a scratch Db under fresh segment ids.
+	// Until the manifest lists them, a crash leaves the new files unlisted
+	// and recovery removes them.
+	index, err := db.newIndex()
+	if err != nil {
+		return err
+	}
+	restored := &Db{
+		fs:         db.fs,
+		dir:        db.dir,
+		index:      index,
+		indexKind:  db.indexKind,
+		bloomRate:  db.bloomRate,
+		maxSize:    db.maxSize,
+		syncPolicy: db.syncPolicy,
+		nextSegID:  db.nextSegID,
+		now:        db.now,
+	}
+	var newNames []string
+	cleanup := func() {
+		index.Close()
+		for _, seg := range restored.segments {
+			seg.file.Close()
+		}
+		for _, name := range newNames {
+			db.fs.Remove(filepath.Join(db.dir, name))
+			db.fs.Remove(hintPath(filepath.Join(db.dir, name)))
+			db.fs.Remove(bloomPath(filepath.Join(db.dir, name)))
+		}
+	}
+
+	for _, name := range names {
+		newName := fmt.Sprintf("%s%d", segmentPrefix, restored.nextSegID)
+		restored.nextSegID++
+		newNames = append(newNames, newName)
+
+		src, dst := filepath.Join(snapshotDir, name), filepath.Join(db.dir, newName)
+		if err := copyFile(db.fs, src, dst, -1); err != nil {
+			cleanup()
+			return err
+		}
+		copyFile(db.fs, hintPath(src), hintPath(dst), -1)
+		copyFile(db.fs, bloomPath(src), bloomPath(dst), -1)
+	}
+	if err := restored.openSegments(newNames); err != nil {
+		cleanup()
+		return err
+	}
+	if err := index.Err(); err != nil {
+		cleanup()
+		return err
+	}
+	if err := writeManifest(db.fs, db.dir, restored.segments); err != nil {
+		cleanup()
+		return err
+	}
+
+	db.mu.Lock()
+	old, oldIndex := db.segments, db.index
+	db.segments = restored.segments
+	db.index = index
+	db.cache.clear()
+	db.out = restored.segments[len(restored.segments)-1]
+	db.nextSegID = restored.nextSegID
+	db.dirty = false
+	// Replicas cannot follow the log across a restore.
+	db.epoch, db.seq, db.replLog = newEpoch(), 0, nil
+	db.mu.Unlock()
+
+	for _, seg := range old {
+		seg.release()
+	}
+	if err := oldIndex.Close(); err != nil {
+		log.Printf("datastore: failed to close the replaced index: %s", err)
+	}
+
+	if db.out.format != currentFormat {
+		return db.createNewSegment()
+	}
+	return nil
+}
+
+// OpenFromSnapshot opens the database in dir with its contents replaced by
+// the snapshot.
+func OpenFromSnapshot(snapshotDir, dir string, opts ...Option) (*Db, error) {
+	db, err := Open(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Restore(snapshotDir); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func linkOrCopy(fsys FS, src, dst string) error {
+	if err := fsys.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(fsys, src, dst, -1)
+}
+
+// copyFile copies the first n bytes of src, or all of it if n is negative,
+// to a new file dst and syncs it.
+func copyFile(fsys FS, src, dst string, n int64) error {
+	in, err := openFile(fsys, src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if n >= 0 {
+		_, err = io.CopyN(out, in, n)
+	} else {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fsys.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tmp := t.TempDir()
+	expected := fillSegments(t, tmp, 30)
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	snapDir := filepath.Join(t.TempDir(), "snap")
+	if err := db.Snapshot(snapDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot(snapDir); err == nil {
+		t.Errorf("Expected a snapshot into a non-empty directory to fail")
+	}
+
+	for i := 0; i < 7; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "later"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, snapDir)
+
+	restored, err := OpenFromSnapshot(snapDir, t.TempDir(), WithMaxSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	checkContents(t, restored, expected)
+}
+
+func TestSnapshotDuringWrites(t *testing.T) {
+	db, err := OpenWithMaxSize(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every batch writes the same counter to both keys, so a consistent
+	// snapshot never sees them differ.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 300; i++ {
+			var b Batch
+			b.Put("a", strconv.Itoa(i))
+			b.Put("b", strconv.Itoa(i))
+			if err := db.WriteBatch(&b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var snapshots []string
+	for i := 0; i < 5; i++ {
+		dir := filepath.Join(t.TempDir(), "snap")
+		if err := db.Snapshot(dir); err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, dir)
+	}
+	wg.Wait()
+
+	for _, dir := range snapshots {
+		restored, err := OpenFromSnapshot(dir, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, errA := restored.Get("a")
+		b, errB := restored.Get("b")
+		if a != b || (errA == nil) != (errB == nil) {
+			t.Errorf("Snapshot split a batch: a=%q (%v), b=%q (%v)", a, errA, b, errB)
+		}
+		restored.Close()
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tmp := t.TempDir()
+	expected := fillSegments(t, tmp, 30)
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	snapDir := filepath.Join(t.TempDir(), "snap")
+	if err := db.Snapshot(snapDir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%7), fmt.Sprintf("later%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Restore(snapDir); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected)
+	checkFiles(t, tmp)
+
+	if err := db.Put("new", "value"); err != nil {
+		t.Fatal(err)
+	}
+	expected["new"] = "value"
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected)
+	if value, err := db.Get("new"); err != nil || value != "value" {
+		t.Errorf("Expected 'value', got %q (%v)", value, err)
+	}
+	checkFiles(t, tmp)
+
+	if _, err := os.Stat(filepath.Join(snapDir, manifestFileName)); err != nil {
+		t.Errorf("Expected the snapshot to be left in place: %s", err)
+	}
+}
@@ -0,0 +1,289 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// tableBlockSize is how many records of a table share a key kept in
+// memory to find them by.
+const tableBlockSize = 64
+
+var tableMagic = []byte{'K', 'V', 'T', 2}
+
+// Table file layout:
+// (segment header) records... (index) (filter) (footer)
+//
+// The records are sorted by key, one per key, in the segment record
+// format. The index has (kl) (key) (offset) for the first record of every
+// tableBlockSize ones, the filter (k) (words) (bits...). The footer is
+// (index offset) (filter offset) (records) (deletions) (deleted bytes) (tier) (crc) (magic)
+// 8              8               8         8           8               8      4     4
+// with the crc covering everything from the index offset on.
+const tableFooterSize = 56
+
+// table is an immutable sorted file of an LSM. Only its sparse index and
+// Bloom filter are kept in memory.
+type table struct {
+	name     string
+	file     File
+	size     int64
+	dataSize int64
+	count    int64
+	// deletions and deletedBytes count the tombstones among the records,
+	// so that stats need not read the table.
+	deletions    int64
+	deletedBytes int64
+	tier         int
+	blocks       []indexBlock
+	filter       *bloomFilter
+}
+
+// writeTable writes the records each adds, which come sorted by key, to a
+// new table sized for up to count of them, and syncs it.
+func writeTable(fsys FS, path string, tier int, count int64, fpRate float64, each func(add func(e entry) error) error) (*table, error) {
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{file: f, tier: tier, filter: newBloomFilter(count, fpRate)}
+	w := bufio.NewWriter(f)
+	_, err = w.Write(encodeSegmentHeader(currentFormat))
+	t.dataSize = segmentHeaderSize
+	if err == nil {
+		err = each(func(e entry) error {
+			if t.count%tableBlockSize == 0 {
+				t.blocks = append(t.blocks, indexBlock{key: e.key, offset: t.dataSize})
+			}
+			t.filter.add(bloomHash(e.key))
+			e.continued = false
+			n, err := w.Write(e.Encode())
+			t.dataSize += int64(n)
+			t.count++
+			if e.tombstone {
+				t.deletions++
+				t.deletedBytes += int64(n)
+			}
+			return err
+		})
+	}
+
+	if err == nil {
+		var meta []byte
+		for _, b := range t.blocks {
+			meta = binary.LittleEndian.AppendUint32(meta, uint32(len(b.key)))
+			meta = append(meta, b.key...)
+			meta = binary.LittleEndian.AppendUint64(meta, uint64(b.offset))
+		}
+		filterOffset := t.dataSize + int64(len(meta))
+		meta = binary.LittleEndian.AppendUint64(meta, t.filter.k)
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(len(t.filter.bits)))
+		for _, word := range t.filter.bits {
+			meta = binary.LittleEndian.AppendUint64(meta, word)
+		}
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(t.dataSize))
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(filterOffset))
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(t.count))
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(t.deletions))
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(t.deletedBytes))
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(t.tier))
+		meta = binary.LittleEndian.AppendUint32(meta, crc32.ChecksumIEEE(meta))
+		meta = append(meta, tableMagic...)
+		_, err = w.Write(meta)
+		t.size = t.dataSize + int64(len(meta))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		fsys.Remove(path)
+		return nil, err
+	}
+	return t, nil
+}
+
+func openTable(fsys FS, path string) (*table, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTableMeta(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("table %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func readTableMeta(f File) (*table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < segmentHeaderSize+tableFooterSize {
+		return nil, fmt.Errorf("%w: table is too short", ErrCorrupted)
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := f.ReadAt(footer, size-tableFooterSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[tableFooterSize-4:], tableMagic) {
+		return nil, fmt.Errorf("%w: unknown table format", ErrCorrupted)
+	}
+	t := &table{
+		file:         f,
+		size:         size,
+		dataSize:     int64(binary.LittleEndian.Uint64(footer)),
+		count:        int64(binary.LittleEndian.Uint64(footer[16:])),
+		deletions:    int64(binary.LittleEndian.Uint64(footer[24:])),
+		deletedBytes: int64(binary.LittleEndian.Uint64(footer[32:])),
+		tier:         int(binary.LittleEndian.Uint64(footer[40:])),
+	}
+	filterOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if t.dataSize < segmentHeaderSize || filterOffset < t.dataSize || filterOffset > size-tableFooterSize {
+		return nil, fmt.Errorf("%w: bad table footer", ErrCorrupted)
+	}
+
+	meta := make([]byte, size-4-t.dataSize)
+	if _, err := f.ReadAt(meta, t.dataSize); err != nil {
+		return nil, err
+	}
+	body, sum := meta[:len(meta)-4], binary.LittleEndian.Uint32(meta[len(meta)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: table checksum mismatch", ErrCorrupted)
+	}
+
+	index, filter := body[:filterOffset-t.dataSize], body[filterOffset-t.dataSize:len(body)-(tableFooterSize-8)]
+	for len(index) > 0 {
+		if len(index) < 4 || len(index) < 4+int(binary.LittleEndian.Uint32(index))+8 {
+			return nil, fmt.Errorf("%w: truncated table index", ErrCorrupted)
+		}
+		kl := int(binary.LittleEndian.Uint32(index))
+		t.blocks = append(t.blocks, indexBlock{
+			key:    string(index[4 : 4+kl]),
+			offset: int64(binary.LittleEndian.Uint64(index[4+kl:])),
+		})
+		index = index[4+kl+8:]
+	}
+	if len(filter) < 16 || len(filter) != 16+8*int(binary.LittleEndian.Uint64(filter[8:])) {
+		return nil, fmt.Errorf("%w: bad table filter", ErrCorrupted)
+	}
+	t.filter = &bloomFilter{k: binary.LittleEndian.Uint64(filter), n: t.count, capacity: t.count}
+	for pos := 16; pos < len(filter); pos += 8 {
+		t.filter.bits = append(t.filter.bits, binary.LittleEndian.Uint64(filter[pos:]))
+	}
+	if len(t.filter.bits) == 0 || t.filter.k == 0 {
+		return nil, fmt.Errorf("%w: bad table filter", ErrCorrupted)
+	}
+	return t, nil
+}
+
+// get returns the record of key in the table, if there is one.
+func (t *table) get(key string, h1, h2 uint64) (entry, bool, error) {
+	if !t.filter.mayContain(h1, h2) {
+		return entry{}, false, nil
+	}
+	i := sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].key > key }) - 1
+	if i < 0 {
+		return entry{}, false, nil
+	}
+	end := t.dataSize
+	if i+1 < len(t.blocks) {
+		end = t.blocks[i+1].offset
+	}
+	in := bufio.NewReader(io.NewSectionReader(t.file, t.blocks[i].offset, end-t.blocks[i].offset))
+	for {
+		var record entry
+		if _, err := record.decodeFromReader(in, currentFormat); errors.Is(err, io.EOF) {
+			return entry{}, false, nil
+		} else if err != nil {
+			return entry{}, false, err
+		}
+		if record.key >= key {
+			return record, record.key == key, nil
+		}
+	}
+}
+
+// cursor returns a cursor at the first record of the table not less than
+// start.
+func (t *table) cursor(start string) *entryCursor {
+	i := max(sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].key > start })-1, 0)
+	offset := t.dataSize
+	if i < len(t.blocks) {
+		offset = t.blocks[i].offset
+	}
+	c := &entryCursor{r: bufio.NewReader(io.NewSectionReader(t.file, offset, t.dataSize-offset))}
+	for c.next(); c.ok && c.entry.key < start; c.next() {
+	}
+	return c
+}
+
+// entryCursor walks the records of a table, or the pending ones, in order.
+type entryCursor struct {
+	r       *bufio.Reader
+	pending []entry
+	entry   entry
+	ok      bool
+	err     error
+}
+
+func (c *entryCursor) next() {
+	if c.r == nil {
+		c.ok = len(c.pending) > 0
+		if c.ok {
+			c.entry, c.pending = c.pending[0], c.pending[1:]
+		}
+		return
+	}
+	c.entry = entry{}
+	_, err := c.entry.decodeFromReader(c.r, currentFormat)
+	c.ok = err == nil
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.err = err
+	}
+}
+
+// mergeCursors calls fn with the latest record of every key the cursors
+// have before end, in order, until fn returns false. The cursors go from
+// the newest records to the oldest.
+func mergeCursors(cursors []*entryCursor, end string, fn func(e entry) bool) error {
+	for {
+		first := -1
+		for i, c := range cursors {
+			if c.ok && (first < 0 || c.entry.key < cursors[first].entry.key) {
+				first = i
+			}
+		}
+		if first < 0 {
+			break
+		}
+		e := cursors[first].entry
+		for _, c := range cursors {
+			if c.ok && c.entry.key == e.key {
+				c.next()
+			}
+		}
+		if (end != "" && e.key >= end) || !fn(e) {
+			break
+		}
+	}
+	for _, c := range cursors {
+		if c.err != nil {
+			return c.err
+		}
+	}
+	return nil
+}
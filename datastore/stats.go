@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"path/filepath"
+	"time"
+)
+
+type Stats struct {
+	LiveKeys     int
+	TotalBytes   int64
+	LiveBytes    int64
+	DeadBytes    int64
+	GarbageRatio float64
+	Segments     []SegmentStats
+
+	MergeCount        int
+	LastMerge         time.Time
+	LastMergeDuration time.Duration
+
+	CacheHits   int64
+	CacheMisses int64
+	CacheBytes  int64
+
+	// BloomNegatives counts lookups of missing keys answered by the
+	// filters alone, BloomFalsePositives those the filters let through.
+	// BloomFalsePositiveRate is the share of the latter among both.
+	BloomNegatives         int64
+	BloomFalsePositives    int64
+	BloomFalsePositiveRate float64
+	BloomBytes             int64
+
+	// UncompressedBytes and CompressedBytes add up the values compressed
+	// since the database was opened before and after compression, and
+	// CompressionRatio is the latter over the former.
+	UncompressedBytes int64
+	CompressedBytes   int64
+	CompressionRatio  float64
+}
+
+func (s *Stats) setBloomRate() {
+	if n := s.BloomNegatives + s.BloomFalsePositives; n > 0 {
+		s.BloomFalsePositiveRate = float64(s.BloomFalsePositives) / float64(n)
+	}
+}
+
+func (s *Stats) setCompressionRatio() {
+	if s.UncompressedBytes > 0 {
+		s.CompressionRatio = float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+	}
+}
+
+type SegmentStats struct {
+	Name       string
+	TotalBytes int64
+	LiveBytes  int64
+	DeadBytes  int64
+	LiveKeys   int64
+	DeadKeys   int64
+}
+
+func (db *Db) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		LiveKeys:          db.index.Len(),
+		MergeCount:        db.mergeCount,
+		LastMerge:         db.lastMerge,
+		LastMergeDuration: db.lastMergeDuration,
+	}
+	stats.CacheHits, stats.CacheMisses, stats.CacheBytes = db.cache.stats()
+	stats.BloomNegatives = db.bloomNegatives.Load()
+	stats.BloomFalsePositives = db.bloomFalsePositives.Load()
+	stats.setBloomRate()
+	stats.UncompressedBytes = db.uncompressedBytes.Load()
+	stats.CompressedBytes = db.compressedBytes.Load()
+	stats.setCompressionRatio()
+	for _, seg := range db.segments {
+		if seg.filter != nil {
+			stats.BloomBytes += seg.filter.size()
+		}
+		var headerSize int64
+		if seg.format != formatLegacy {
+			headerSize = segmentHeaderSize
+		}
+		s := SegmentStats{
+			Name:       filepath.Base(seg.filePath),
+			TotalBytes: seg.size,
+			LiveBytes:  seg.size - headerSize - seg.deadBytes,
+			DeadBytes:  seg.deadBytes,
+			LiveKeys:   seg.liveKeys,
+			DeadKeys:   seg.records - seg.liveKeys,
+		}
+		stats.Segments = append(stats.Segments, s)
+		stats.TotalBytes += s.TotalBytes
+		stats.LiveBytes += s.LiveBytes
+		stats.DeadBytes += s.DeadBytes
+	}
+	if stats.TotalBytes > 0 {
+		stats.GarbageRatio = float64(stats.DeadBytes) / float64(stats.TotalBytes)
+	}
+	return stats
+}
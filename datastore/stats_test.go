@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	db, err := Open(t.TempDir(), WithMaxSize(100), WithCompactionPolicy(CompactionPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	size := func(key, value string) int64 {
+		return int64(len((&entry{key: key, value: value}).Encode()))
+	}
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "v1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	if stats.LiveKeys != 1 {
+		t.Errorf("Expected 1 live key, got %d", stats.LiveKeys)
+	}
+	dead := size("k1", "v1") + size("k2", "v2") + int64(len((&entry{key: "k2", tombstone: true}).Encode()))
+	if stats.DeadBytes != dead {
+		t.Errorf("Expected %d dead bytes, got %d", dead, stats.DeadBytes)
+	}
+	if stats.LiveBytes != size("k1", "v1.1") {
+		t.Errorf("Expected %d live bytes, got %d", size("k1", "v1.1"), stats.LiveBytes)
+	}
+	if total, _ := db.Size(); stats.TotalBytes != total {
+		t.Errorf("Expected total bytes %d to match Size(), got %d", total, stats.TotalBytes)
+	}
+	var deadKeys int64
+	for _, seg := range stats.Segments {
+		deadKeys += seg.DeadKeys
+	}
+	if deadKeys != 3 {
+		t.Errorf("Expected 3 dead records, got %d", deadKeys)
+	}
+	if stats.GarbageRatio <= 0 || stats.MergeCount != 0 || !stats.LastMerge.IsZero() {
+		t.Errorf("Unexpected stats before merge: %+v", stats)
+	}
+
+	if err := db.Put("k3", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats = db.Stats()
+	if stats.MergeCount != 1 || stats.LastMerge.IsZero() || stats.LastMergeDuration <= 0 {
+		t.Errorf("Expected merge to be recorded, got %+v", stats)
+	}
+	if merged := stats.Segments[0]; merged.DeadBytes != 0 || merged.DeadKeys != 0 {
+		t.Errorf("Expected no garbage in the merged segment, got %+v", merged)
+	}
+	if stats.LiveKeys != 2 {
+		t.Errorf("Expected 2 live keys after merge, got %d", stats.LiveKeys)
+	}
+}
+
+func TestStatsSurviveReopen(t *testing.T) {
+	tmp := t.TempDir()
+	fillSegments(t, tmp, 30)
+
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHints := db.Stats()
+	var paths []string
+	for _, seg := range db.segments {
+		paths = append(paths, seg.filePath)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seg := range withHints.Segments {
+		if seg.DeadBytes < 0 || seg.LiveBytes < 0 || seg.DeadKeys < 0 || seg.LiveKeys < 0 {
+			t.Fatalf("Negative counters: %+v", seg)
+		}
+	}
+
+	for _, path := range paths {
+		os.Remove(hintPath(path))
+	}
+	db, err = OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	scanned := db.Stats()
+
+	if fmt.Sprint(withHints.Segments) != fmt.Sprint(scanned.Segments) {
+		t.Errorf("Counters differ between hint and full scan:\n%v\n%v", withHints.Segments, scanned.Segments)
+	}
+}
+
+// TestStatsDuringWrites is meant for the race detector: stats are read
+// while the writer appends and seals segments.
+func TestStatsDuringWrites(t *testing.T) {
+	db, err := Open(t.TempDir(), WithMaxSize(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i%20), fmt.Sprintf("value%d", i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if s := db.Stats(); s.LiveKeys != 20 {
+				t.Errorf("Expected 20 live keys, got %d", s.LiveKeys)
+			}
+			return
+		default:
+			db.Stats()
+			db.Size()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"math"
+	"time"
+)
+
+// Store is the part of the API every storage engine has. The other
+// interfaces below are capabilities an engine may add; callers check for
+// them with a type assertion.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	// Delete returns ErrNotFound if key does not exist.
+	Delete(key string) error
+	Size() (int64, error)
+	Close() error
+}
+
+// TypedStore stores int64 values next to strings. Reading a value as the
+// other type returns ErrTypeMismatch.
+type TypedStore interface {
+	GetInt64(key string) (int64, error)
+	PutInt64(key string, value int64) error
+	// Increment adds delta to the int64 stored at key, starting from 0 if
+	// there is none, and returns the new value. It fails with
+	// ErrTypeMismatch if key holds a string and with ErrOverflow if the
+	// result does not fit.
+	Increment(key string, delta int64) (int64, error)
+}
+
+type ExpiringStore interface {
+	// PutWithTTL stores a value that is treated as missing once ttl passes.
+	PutWithTTL(key, value string, ttl time.Duration) error
+}
+
+type ConditionalStore interface {
+	// CompareAndSwap replaces the value of key only if it currently equals
+	// expected, returning ErrConflict otherwise.
+	CompareAndSwap(key, expected, value string) error
+	// PutIfAbsent stores the value only if key does not exist yet,
+	// returning ErrExists otherwise.
+	PutIfAbsent(key, value string) error
+}
+
+type BatchStore interface {
+	WriteBatch(b *Batch) error
+}
+
+type ScanStore interface {
+	// Scan returns an iterator over the live keys in [start, end) as they
+	// are when the scan starts.
+	Scan(start, end string) *Iterator
+	// ScanLimit is like Scan but stops after limit keys if limit is
+	// positive.
+	ScanLimit(start, end string, limit int) *Iterator
+	ScanPrefix(prefix string) *Iterator
+}
+
+type StatsStore interface {
+	Stats() Stats
+}
+
+type Compactor interface {
+	Compact() error
+}
+
+type Snapshotter interface {
+	Snapshot(dir string) error
+}
+
+// FullStore has every capability, as the on-disk engines do.
+type FullStore interface {
+	Store
+	TypedStore
+	ExpiringStore
+	ConditionalStore
+	BatchStore
+	ScanStore
+	StatsStore
+	Compactor
+	Snapshotter
+}
+
+var (
+	_ FullStore = (*Db)(nil)
+	_ FullStore = (*ShardedDb)(nil)
+	_ FullStore = (*LSM)(nil)
+
+	_ Store            = (*MemStore)(nil)
+	_ TypedStore       = (*MemStore)(nil)
+	_ ExpiringStore    = (*MemStore)(nil)
+	_ ConditionalStore = (*MemStore)(nil)
+	_ BatchStore       = (*MemStore)(nil)
+	_ ScanStore        = (*MemStore)(nil)
+	_ StatsStore       = (*MemStore)(nil)
+	_ Compactor        = (*MemStore)(nil)
+)
+
+// The rules of the conditional writes are shared by the engines, which
+// pass them the current record of the key and the error looking it up
+// returned.
+
+// applyIncrement returns the record Increment writes for key and its
+// value. The counter keeps its expiry, if any.
+func applyIncrement(key string, cur entry, err error, delta int64) (entry, int64, error) {
+	var n int64
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		return entry{}, 0, err
+	case cur.valueType != TypeInt64:
+		return entry{}, 0, ErrTypeMismatch
+	default:
+		n = cur.int64()
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return entry{}, 0, ErrOverflow
+	}
+	n += delta
+	next := int64Entry(key, n)
+	next.expiresAt = cur.expiresAt
+	return next, n, nil
+}
+
+// checkSwap tells whether CompareAndSwap may replace cur.
+func checkSwap(cur entry, err error, expected string) error {
+	switch {
+	case err != nil:
+		return err
+	case cur.valueType != TypeString:
+		return ErrTypeMismatch
+	case cur.value != expected:
+		return ErrConflict
+	}
+	return nil
+}
+
+// checkAbsent tells whether PutIfAbsent may write.
+func checkAbsent(err error) error {
+	if err == nil {
+		return ErrExists
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	return nil
+}
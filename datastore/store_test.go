@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	open := map[string]func(t *testing.T) FullStore{
+		"log": func(t *testing.T) FullStore {
+			db, err := Open(t.TempDir(), WithMaxSize(200))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"lsm": func(t *testing.T) FullStore {
+			l, err := OpenLSM(t.TempDir(), WithMaxSize(200))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		},
+	}
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			testStore(t, s)
+		})
+	}
+	t.Run("memory", func(t *testing.T) {
+		s := NewMemStore()
+		defer s.Close()
+		testStore(t, s)
+	})
+}
+
+// testStore checks the semantics every engine shares, using whichever
+// capabilities s has.
+func testStore(t *testing.T, s Store) {
+	for i := 0; i < 30; i++ {
+		if err := s.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("key00", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("key00"); err != nil || v != "again" {
+		t.Errorf("Get(key00) = %q (%v), wanted again", v, err)
+	}
+	if err := s.Delete("key01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("key01"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Delete("key01"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting a missing key, got %v", err)
+	}
+	if size, err := s.Size(); err != nil || size <= 0 {
+		t.Errorf("Size = %d (%v), wanted a positive size", size, err)
+	}
+
+	if typed, ok := s.(TypedStore); ok {
+		if n, err := typed.Increment("counter", 2); err != nil || n != 2 {
+			t.Errorf("Increment = %d (%v), wanted 2", n, err)
+		}
+		if _, err := typed.Increment("counter", math.MaxInt64); err != ErrOverflow {
+			t.Errorf("Expected ErrOverflow, got %v", err)
+		}
+		if _, err := s.Get("counter"); err != ErrTypeMismatch {
+			t.Errorf("Expected ErrTypeMismatch reading an int64 as a string, got %v", err)
+		}
+		if _, err := typed.GetInt64("key00"); err != ErrTypeMismatch {
+			t.Errorf("Expected ErrTypeMismatch reading a string as an int64, got %v", err)
+		}
+	}
+	if conditional, ok := s.(ConditionalStore); ok {
+		if err := conditional.PutIfAbsent("key00", "x"); err != ErrExists {
+			t.Errorf("Expected ErrExists, got %v", err)
+		}
+		if err := conditional.CompareAndSwap("key00", "stale", "x"); err != ErrConflict {
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+		if err := conditional.CompareAndSwap("key00", "again", "swapped"); err != nil {
+			t.Error(err)
+		}
+		if err := conditional.CompareAndSwap("missing", "", "x"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	if expiring, ok := s.(ExpiringStore); ok {
+		if err := expiring.PutWithTTL("short", "v", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := expiring.PutWithTTL("short", "v", 0); err == nil {
+			t.Error("Expected a zero ttl to be rejected")
+		}
+		time.Sleep(5 * time.Millisecond)
+		if _, err := s.Get("short"); err != ErrNotFound {
+			t.Errorf("Expected an expired key to be missing, got %v", err)
+		}
+	}
+	if batcher, ok := s.(BatchStore); ok {
+		var b Batch
+		b.Put("key30", "batched")
+		b.Delete("key02")
+		b.Delete("never")
+		if err := batcher.WriteBatch(&b); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get("key30"); err != nil || v != "batched" {
+			t.Errorf("Get(key30) = %q (%v), wanted batched", v, err)
+		}
+	}
+	if scanner, ok := s.(ScanStore); ok {
+		it := scanner.ScanPrefix("key0")
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		it.Close()
+		if fmt.Sprint(keys) != "[key00 key03 key04 key05 key06 key07 key08 key09]" {
+			t.Errorf("Unexpected scan: %v", keys)
+		}
+
+		it = scanner.ScanLimit("key0", "", 3)
+		keys = nil
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		it.Close()
+		if fmt.Sprint(keys) != "[key00 key03 key04]" {
+			t.Errorf("Unexpected limited scan: %v", keys)
+		}
+	}
+	if stats, ok := s.(StatsStore); ok {
+		if compactor, ok := s.(Compactor); ok {
+			if err := compactor.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// key00..key30 without key01 and key02, and the counter. An
+		// expired record may count until a merge drops it.
+		if n := stats.Stats().LiveKeys; n != 30 && n != 31 {
+			t.Errorf("Expected 30 live keys, got %d", n)
+		}
+	}
+}
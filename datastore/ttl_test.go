@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	nanos atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{}
+	c.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, c.nanos.Load())
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.nanos.Add(int64(d))
+}
+
+func openWithClock(t *testing.T, dir string, clock *fakeClock, opts ...Option) *Db {
+	t.Helper()
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.now = clock.Now
+	return db
+}
+
+func TestPutWithTTL(t *testing.T) {
+	clock := newFakeClock()
+	db := openWithClock(t, t.TempDir(), clock)
+	defer db.Close()
+
+	if err := db.PutWithTTL("session", "data", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("bad", "data", 0); err == nil {
+		t.Error("Expected an error for zero ttl")
+	}
+
+	if value, err := db.Get("session"); err != nil || value != "data" {
+		t.Errorf("Expected 'data' before expiry, got %q (%v)", value, err)
+	}
+
+	clock.Advance(time.Minute)
+
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after expiry, got %v", err)
+	}
+	if res := collect(t, db.Scan("", "")); len(res) != 1 || res[0][0] != "plain" {
+		t.Errorf("Expected scan to skip expired keys, got %v", res)
+	}
+	if err := db.Delete("session"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting expired key, got %v", err)
+	}
+	if err := db.PutIfAbsent("session", "again"); err != nil {
+		t.Errorf("Expected PutIfAbsent to succeed for expired key, got %v", err)
+	}
+}
+
+func TestTTLSurvivesReopen(t *testing.T) {
+	tmp := t.TempDir()
+	clock := newFakeClock()
+
+	db := openWithClock(t, tmp, clock, WithMaxSize(100))
+	db.writeMutex.Lock()
+	for _, e := range []entry{
+		{key: "k1", value: "v1", expiresAt: clock.Now().Add(time.Minute).UnixNano()},
+		{key: "k2", value: "v2", expiresAt: clock.Now().Add(time.Hour).UnixNano()},
+		{key: "k3", value: "v3", expiresAt: clock.Now().Add(time.Minute).UnixNano()},
+		{key: "k4", value: "v4"},
+	} {
+		if _, err := db.appendEntries([]entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.writeMutex.Unlock()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	db = openWithClock(t, tmp, clock, WithMaxSize(100))
+	defer db.Close()
+
+	for key, expected := range map[string]string{"k2": "v2", "k4": "v4"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Get(%q) = %q (%v), wanted %q", key, value, err, expected)
+		}
+	}
+	for _, key := range []string{"k1", "k3"} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Get(%q) expected ErrNotFound after reopen, got %v", key, err)
+		}
+	}
+}
+
+func TestMergeDropsExpired(t *testing.T) {
+	clock := newFakeClock()
+	db := openWithClock(t, t.TempDir(), clock, WithMaxSize(60))
+	defer db.Close()
+
+	if err := db.PutWithTTL("expiring", "value", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("filler", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Second)
+	db.mergeSegments()
+
+	expected := int64(segmentHeaderSize + len((&entry{key: "kept", value: "value"}).Encode()))
+	if size := db.segments[0].size; size != expected {
+		t.Errorf("Expected merged size %d, got %d", expected, size)
+	}
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Expected 'value', got %q (%v)", value, err)
+	}
+}
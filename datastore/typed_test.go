@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInt64Values(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithMaxSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.PutInt64("counter", -7); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		if n, err := db.GetInt64("counter"); err != nil || n != -7 {
+			t.Errorf("Expected -7, got %d (%v)", n, err)
+		}
+		if _, err := db.Get("counter"); err != ErrTypeMismatch {
+			t.Errorf("Expected ErrTypeMismatch reading int64 as string, got %v", err)
+		}
+		if _, err := db.GetInt64("name"); err != ErrTypeMismatch {
+			t.Errorf("Expected ErrTypeMismatch reading string as int64, got %v", err)
+		}
+		if _, err := db.GetInt64("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	check()
+
+	if err := db.CompareAndSwap("counter", "-7", "new"); err != ErrTypeMismatch {
+		t.Errorf("Expected ErrTypeMismatch from CompareAndSwap on int64, got %v", err)
+	}
+
+	it := db.Scan("", "")
+	var types []ValueType
+	for it.Next() {
+		types = append(types, it.Type())
+		if it.Type() == TypeInt64 && it.Int64() != -7 {
+			t.Errorf("Expected -7 from iterator, got %d", it.Int64())
+		}
+	}
+	it.Close()
+	if len(types) != 2 || types[0] != TypeInt64 || types[1] != TypeString {
+		t.Errorf("Unexpected types from scan: %v", types)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put("filler", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp, WithMaxSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if err := db.Put("counter", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("counter"); err != nil || value != "text" {
+		t.Errorf("Expected a string to replace the int64, got %q (%v)", value, err)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	tmp := t.TempDir()
+	clock := newFakeClock()
+	db := openWithClock(t, tmp, clock)
+	defer func() { db.Close() }()
+
+	if n, err := db.Increment("counter", 5); err != nil || n != 5 {
+		t.Errorf("Expected a missing counter to start from 0, got %d (%v)", n, err)
+	}
+	if n, err := db.Increment("counter", -2); err != nil || n != 3 {
+		t.Errorf("Expected 3, got %d (%v)", n, err)
+	}
+
+	if err := db.Put("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Increment("name", 1); err != ErrTypeMismatch {
+		t.Errorf("Expected ErrTypeMismatch incrementing a string, got %v", err)
+	}
+
+	if err := db.PutInt64("big", math.MaxInt64-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Increment("big", 2); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+	if n, _ := db.GetInt64("big"); n != math.MaxInt64-1 {
+		t.Errorf("Expected the overflowing increment to leave the value, got %d", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := db.Increment("concurrent", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := db.GetInt64("concurrent"); err != nil || n != 1000 {
+		t.Errorf("Expected 1000 after concurrent increments, got %d (%v)", n, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openWithClock(t, tmp, clock)
+	if n, err := db.GetInt64("counter"); err != nil || n != 3 {
+		t.Errorf("Expected 3 after reopen, got %d (%v)", n, err)
+	}
+}
+
+func TestIncrementKeepsExpiry(t *testing.T) {
+	clock := newFakeClock()
+	db := openWithClock(t, t.TempDir(), clock)
+	defer db.Close()
+
+	db.writeMutex.Lock()
+	e := int64Entry("limited", 10)
+	e.expiresAt = clock.Now().Add(time.Minute).UnixNano()
+	if _, err := db.appendEntries([]entry{e}); err != nil {
+		t.Fatal(err)
+	}
+	db.writeMutex.Unlock()
+
+	if n, err := db.Increment("limited", 1); err != nil || n != 11 {
+		t.Errorf("Expected 11, got %d (%v)", n, err)
+	}
+	clock.Advance(time.Minute)
+	if _, err := db.GetInt64("limited"); err != ErrNotFound {
+		t.Errorf("Expected the incremented counter to keep its expiry, got %v", err)
+	}
+	if n, err := db.Increment("limited", 1); err != nil || n != 1 {
+		t.Errorf("Expected an expired counter to start over, got %d (%v)", n, err)
+	}
+}